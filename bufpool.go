@@ -0,0 +1,98 @@
+package diskqueue
+
+import (
+	"sort"
+	"sync"
+)
+
+// MessageReader is implemented by queues that can hand out messages whose
+// buffers are recycled once they were processed
+type MessageReader interface {
+	// MessageChan is read from like ReadChan(), each message is received
+	// from only one of the two
+	MessageChan() <-chan Message
+}
+
+// Message is a message received from MessageChan(), or written with
+// PutMessage() (see MessagePutter) along with its headers
+//
+// when the queue was created with Options.PoolBuffers, Body is backed by a
+// pooled buffer that is reused once Release() is called: Body must not be
+// used afterwards and Release() must be called at most once
+type Message struct {
+	Headers map[string][]byte
+	Body    []byte
+
+	buf  *[]byte
+	pool *bufferPool
+}
+
+// Release hands the buffer backing Body back to the queue, it is a no-op
+// when buffers are not pooled
+func (m Message) Release() {
+	if m.buf != nil {
+		m.pool.put(m.buf)
+	}
+}
+
+// minBufferClass is the smallest size class, smaller messages share it
+const minBufferClass = 64
+
+// bufferPool recycles message buffers in size classes that double from
+// minMsgSize up to maxMsgSize
+type bufferPool struct {
+	classes []int // capacity of the buffers of each class, ascending
+	pools   []sync.Pool
+}
+
+func newBufferPool(minMsgSize int32, maxMsgSize int32) *bufferPool {
+	var bp bufferPool
+
+	size := int64(minBufferClass)
+	for size < int64(minMsgSize) {
+		size *= 2
+	}
+	for size < int64(maxMsgSize) {
+		bp.classes = append(bp.classes, int(size))
+		size *= 2
+	}
+	bp.classes = append(bp.classes, int(maxMsgSize))
+	bp.pools = make([]sync.Pool, len(bp.classes))
+
+	return &bp
+}
+
+// get returns a buffer of length size from the smallest class it fits in
+func (bp *bufferPool) get(size int) *[]byte {
+	i := sort.SearchInts(bp.classes, size)
+	if i == len(bp.classes) {
+		// larger than maxMsgSize, not worth keeping
+		buf := make([]byte, size)
+		return &buf
+	}
+
+	if v := bp.pools[i].Get(); v != nil {
+		buf := v.(*[]byte)
+		*buf = (*buf)[:size]
+		return buf
+	}
+
+	buf := make([]byte, size, bp.classes[i])
+	return &buf
+}
+
+// put recycles a buffer returned by get
+func (bp *bufferPool) put(buf *[]byte) {
+	i := sort.SearchInts(bp.classes, cap(*buf))
+	if i == len(bp.classes) || bp.classes[i] != cap(*buf) {
+		return
+	}
+	bp.pools[i].Put(buf)
+}
+
+// releaseFrame recycles the buffer of a frame that is no longer used
+func (d *diskQueue) releaseFrame(f frame) {
+	if f.buf != nil {
+		d.bufPool.put(f.buf)
+	}
+}
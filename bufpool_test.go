@@ -0,0 +1,128 @@
+package diskqueue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBufferPoolClasses(t *testing.T) {
+	Equal(t, []int{64, 128, 256, 512, 1000}, newBufferPool(0, 1000).classes)
+	Equal(t, []int{128, 256, 512, 1024}, newBufferPool(100, 1<<10).classes)
+	Equal(t, []int{10}, newBufferPool(0, 10).classes)
+
+	bp := newBufferPool(0, 1000)
+	buf := bp.get(65)
+	Equal(t, 65, len(*buf))
+	Equal(t, 128, cap(*buf))
+	bp.put(buf)
+
+	buf = bp.get(1000)
+	Equal(t, 1000, cap(*buf))
+	buf = bp.get(1001)
+	Equal(t, 1001, cap(*buf))
+	// buffers that do not match a class are dropped
+	bp.put(buf)
+}
+
+func TestDiskQueuePooledBuffers(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_pooled_buffers" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1 << 10,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		PoolBuffers:     true,
+	}, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	for i := 0; i < 100; i++ {
+		Nil(t, dq.Put(bytes.Repeat([]byte{byte(i)}, i*10)))
+	}
+
+	for i := 0; i < 100; i++ {
+		expected := bytes.Repeat([]byte{byte(i)}, i*10)
+		if i%3 == 0 {
+			// ReadChan() hands out buffers that are never reused
+			data := <-dq.ReadChan()
+			Equal(t, expected, data)
+			Equal(t, len(data), cap(data))
+			continue
+		}
+		msg := <-dq.(MessageReader).MessageChan()
+		Equal(t, expected, msg.Body)
+		msg.Release()
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueMessageChan(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_message_chan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	// without pooling, releasing does nothing
+	Nil(t, dq.Put([]byte("test")))
+	msg := <-dq.(MessageReader).MessageChan()
+	Equal(t, []byte("test"), msg.Body)
+	msg.Release()
+	Equal(t, []byte("test"), msg.Body)
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueuePooledBuffersPeeked(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_pooled_buffers_peeked" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1 << 10,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		PoolBuffers:     true,
+	}, l)
+	NotNil(t, dq)
+
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put(bytes.Repeat([]byte{byte(i)}, 100)))
+	}
+
+	// releasing a message that was peeked at does not recycle its buffer
+	peeked := make([][]byte, 0, 10)
+	for i := 0; i < 10; i++ {
+		data, err := dq.(Peeker).Peek(context.Background())
+		Nil(t, err)
+		peeked = append(peeked, data)
+		msg := <-dq.(MessageReader).MessageChan()
+		msg.Release()
+	}
+	for i, data := range peeked {
+		Equal(t, bytes.Repeat([]byte{byte(i)}, 100), data)
+	}
+	dq.Close()
+}
@@ -0,0 +1,185 @@
+package diskqueue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// Codec converts the values put into a TypedQueue to and from messages
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	// Decode stores the value encoded in data in the value pointed to by v
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec encodes values with encoding/gob, each message carries the
+// description of its type so that it can be decoded on its own
+type GobCodec struct{}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// DecodeErrorHandler is handed the messages that could not be decoded
+type DecodeErrorHandler func(data []byte, err error)
+
+// DeadLetter returns a DecodeErrorHandler that puts the messages into sink,
+// e.g. another Diskqueue, so that they can be inspected later
+func DeadLetter(sink Interface, logf AppLogFunc) DecodeErrorHandler {
+	return func(data []byte, err error) {
+		putErr := sink.Put(data)
+		if putErr != nil {
+			logf(ERROR, "TYPEDQUEUE: failed to dead-letter message that failed to decode (%s) - %s", err, putErr)
+		}
+	}
+}
+
+// TypedQueue puts and receives values encoded by a Codec into an Interface
+type TypedQueue struct {
+	sync.Mutex
+
+	queue         Interface
+	codec         Codec
+	onDecodeError DecodeErrorHandler
+	exitFlag      int32
+
+	logf AppLogFunc
+
+	exitChan chan int
+	// closed once the queue was closed, unless it is a Lifecycle
+	doneChan chan struct{}
+}
+
+// NewTyped wraps queue, encoding its messages with codec
+//
+// messages that fail to decode are handed to onDecodeError and skipped.
+// When it is nil they are logged and dropped
+func NewTyped(queue Interface, codec Codec, onDecodeError DecodeErrorHandler, logf AppLogFunc) *TypedQueue {
+	return &TypedQueue{
+		queue:         queue,
+		codec:         codec,
+		onDecodeError: onDecodeError,
+		logf:          logf,
+		exitChan:      make(chan int),
+		doneChan:      make(chan struct{}),
+	}
+}
+
+// Put encodes v and writes it to the queue
+func (tq *TypedQueue) Put(v interface{}) error {
+	data, err := tq.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	return tq.queue.Put(data)
+}
+
+// Receive waits for the next message that decodes successfully and stores
+// its value in the value pointed to by v
+//
+// as messages that fail to decode are skipped, v may be partially filled
+// by them and should be reset by the caller between calls if that matters
+func (tq *TypedQueue) Receive(v interface{}) error {
+	for {
+		select {
+		case data, ok := <-tq.queue.ReadChan():
+			if !ok {
+				return ErrClosed
+			}
+			err := tq.codec.Decode(data, v)
+			if err == nil {
+				return nil
+			}
+			if tq.onDecodeError != nil {
+				tq.onDecodeError(data, err)
+			} else {
+				tq.logf(ERROR, "TYPEDQUEUE: dropping message that failed to decode - %s", err)
+			}
+		case <-tq.exitChan:
+			return ErrClosed
+		}
+	}
+}
+
+// Depth returns the depth of the queue
+func (tq *TypedQueue) Depth() int64 {
+	return tq.queue.Depth()
+}
+
+// Close stops pending Receive calls and closes the queue
+func (tq *TypedQueue) Close() error {
+	if !tq.exit() {
+		return nil
+	}
+	defer close(tq.doneChan)
+	return tq.queue.Close()
+}
+
+// Delete stops pending Receive calls and deletes the queue
+func (tq *TypedQueue) Delete() error {
+	if !tq.exit() {
+		return nil
+	}
+	defer close(tq.doneChan)
+	return tq.queue.Delete()
+}
+
+// Done returns the Done() channel of the queue if it is a Lifecycle, or a
+// channel that is closed once Close() or Delete() closed the queue
+func (tq *TypedQueue) Done() <-chan struct{} {
+	if lc, ok := tq.queue.(Lifecycle); ok {
+		return lc.Done()
+	}
+	return tq.doneChan
+}
+
+// Destroy deletes the queue, unless it was already closed, and removes its
+// files, if it is a Lifecycle
+func (tq *TypedQueue) Destroy() error {
+	tq.Delete()
+	// a Close() running along may still be closing the queue
+	<-tq.doneChan
+
+	lc, ok := tq.queue.(Lifecycle)
+	if !ok {
+		return nil
+	}
+	return lc.Destroy()
+}
+
+// exit stops pending Receive calls, it returns false when the queue was
+// already closed
+func (tq *TypedQueue) exit() bool {
+	tq.Lock()
+	defer tq.Unlock()
+
+	if tq.exitFlag == 1 {
+		return false
+	}
+	tq.exitFlag = 1
+	close(tq.exitChan)
+
+	return true
+}
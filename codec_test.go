@@ -0,0 +1,102 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type codecTestEvent struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+func TestTypedQueue(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}} {
+		t.Run(fmt.Sprintf("%T", codec), func(t *testing.T) {
+			l := NewTestLogger(t)
+			dqName := "test_typed_queue" + strconv.Itoa(int(time.Now().Unix()))
+			tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+			if err != nil {
+				panic(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+			NotNil(t, dq)
+
+			tq := NewTyped(dq, codec, nil, l)
+			for i := 0; i < 20; i++ {
+				Nil(t, tq.Put(codecTestEvent{ID: i, Name: strconv.Itoa(i), Tags: []string{"a", "b"}}))
+			}
+			NotNil(t, tq.Put(make(chan int)))
+			// dropped when read as it does not decode
+			Nil(t, dq.Put([]byte("{")))
+			Nil(t, tq.Put(codecTestEvent{ID: 20}))
+			Equal(t, int64(22), tq.Depth())
+
+			for i := 0; i < 21; i++ {
+				var ev codecTestEvent
+				Nil(t, tq.Receive(&ev))
+				Equal(t, i, ev.ID)
+			}
+			Equal(t, int64(0), tq.Depth())
+
+			errChan := make(chan error)
+			go func() {
+				var ev codecTestEvent
+				errChan <- tq.Receive(&ev)
+			}()
+			time.Sleep(20 * time.Millisecond)
+			Nil(t, tq.Close())
+			Equal(t, ErrClosed, <-errChan)
+			// closing again does nothing
+			Nil(t, tq.Close())
+		})
+	}
+}
+
+func TestTypedQueueDeadLetter(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_typed_queue_dead_letter" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	Nil(t, os.Mkdir(filepath.Join(tmpDir, "dead"), 0755))
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	dead := New(dqName, filepath.Join(tmpDir, "dead"), 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dead)
+
+	var decodeErrs []error
+	tq := NewTyped(dq, JSONCodec{}, func(data []byte, err error) {
+		decodeErrs = append(decodeErrs, err)
+		DeadLetter(dead, l)(data, err)
+	}, l)
+
+	Nil(t, tq.Put(codecTestEvent{ID: 1}))
+	Nil(t, dq.Put([]byte("not json")))
+	Nil(t, dq.Put([]byte(`{"ID": "one"}`)))
+	Nil(t, tq.Put(codecTestEvent{ID: 2}))
+
+	var ev codecTestEvent
+	Nil(t, tq.Receive(&ev))
+	Equal(t, 1, ev.ID)
+	ev = codecTestEvent{}
+	Nil(t, tq.Receive(&ev))
+	Equal(t, 2, ev.ID)
+
+	Equal(t, 2, len(decodeErrs))
+	Equal(t, int64(2), dead.Depth())
+	Equal(t, []byte("not json"), <-dead.ReadChan())
+	Equal(t, []byte(`{"ID": "one"}`), <-dead.ReadChan())
+
+	Nil(t, tq.Close())
+	dead.Close()
+}
@@ -0,0 +1,252 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+)
+
+// IdempotentPutter is implemented by queues that can drop the messages
+// producers put again, e.g. when retrying after a timeout
+type IdempotentPutter interface {
+	PutIdempotent(key string, data []byte) error
+}
+
+// defaultDedupMaxKeys is the number of keys remembered when
+// Options.DedupMaxKeys is not set
+const defaultDedupMaxKeys = 1 << 16
+
+// dedupEntry is a key put by PutIdempotent() along with when it was put
+type dedupEntry struct {
+	key  string
+	seen int64 // unix nanoseconds
+}
+
+// PutIdempotent writes a []byte to the queue unless a message with the same
+// key was put within Options.DedupWindow, in which case nothing is written
+// and nil is returned
+//
+// keys are persisted once their message was written, so a crash in between
+// lets a retry through
+func (d *diskQueue) PutIdempotent(key string, data []byte) error {
+	if d.dedupWindow <= 0 {
+		return errors.New("deduplication is not enabled")
+	}
+	if len(key) == 0 || len(key) > math.MaxUint16 {
+		return fmt.Errorf("invalid idempotency key size (%d)", len(key))
+	}
+	return d.put(frame{data: data, dedupKey: key})
+}
+
+func (d *diskQueue) dedupFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.dedup.dat"), d.name)
+}
+
+// writeIdempotent writes f unless its key is still remembered, and then
+// remembers it
+func (d *diskQueue) writeIdempotent(f frame) error {
+	now := time.Now().UnixNano()
+	d.pruneDedup(now)
+
+	if _, ok := d.dedupKeys[f.dedupKey]; ok {
+		d.logf(INFO, "DISKQUEUE(%s) dropped duplicate message with key %q", d.name, f.dedupKey)
+		return nil
+	}
+
+	err := d.checkDepth(1)
+	if err != nil {
+		return err
+	}
+
+	err = d.writeOne(f)
+	if err != nil {
+		return err
+	}
+
+	entry := dedupEntry{key: f.dedupKey, seen: now}
+	d.dedupKeys[entry.key] = entry.seen
+	d.dedupOrder = append(d.dedupOrder, entry)
+	d.pruneDedup(now)
+
+	err = d.appendDedup(entry)
+	if err != nil {
+		// the message is written, only a retry after a restart can
+		// duplicate it
+		d.logf(ERROR, "DISKQUEUE(%s) failed to persist idempotency key - %s", d.name, err)
+	}
+	return nil
+}
+
+// pruneDedup forgets the keys that are older than dedupWindow, and the
+// oldest ones beyond dedupMaxKeys
+func (d *diskQueue) pruneDedup(now int64) {
+	for len(d.dedupOrder) > 0 &&
+		(d.dedupOrder[0].seen <= now-int64(d.dedupWindow) || len(d.dedupOrder) > d.maxDedupKeys()) {
+		oldest := d.dedupOrder[0]
+		// unless the key was put again since
+		if d.dedupKeys[oldest.key] == oldest.seen {
+			delete(d.dedupKeys, oldest.key)
+		}
+		d.dedupOrder = d.dedupOrder[1:]
+	}
+}
+
+func (d *diskQueue) maxDedupKeys() int {
+	if d.dedupMaxKeys <= 0 {
+		return defaultDedupMaxKeys
+	}
+	return d.dedupMaxKeys
+}
+
+// appendDedup appends entry to the dedup file, as a big endian int64 time,
+// uint16 key size and the key, and compacts it once it mostly holds keys
+// that were pruned
+func (d *diskQueue) appendDedup(entry dedupEntry) error {
+	if d.dedupRecords >= 2*int64(len(d.dedupOrder)) && d.dedupRecords >= int64(d.maxDedupKeys()) {
+		return d.compactDedup()
+	}
+
+	var err error
+	if d.dedupFile == nil {
+		d.dedupFile, err = d.fs.OpenFile(d.dedupFileName(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		stat, err := d.dedupFile.Stat()
+		if err != nil {
+			d.dedupFile.Close()
+			d.dedupFile = nil
+			return err
+		}
+		d.dedupSize = stat.Size()
+	}
+
+	record := encodeDedupEntry(entry)
+	_, err = d.dedupFile.Write(record)
+	if err != nil {
+		// drop whatever part of the record was written, so that the
+		// followers' copies keep the same offsets
+		truncErr := d.dedupFile.Truncate(d.dedupSize)
+		if truncErr != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to truncate %s - %s", d.name, d.dedupFileName(), truncErr)
+		}
+		d.dedupFile.Close()
+		d.dedupFile = nil
+		return err
+	}
+	d.replicateWrite(d.dedupFileName(), d.dedupSize, record)
+	d.dedupSize += int64(len(record))
+	d.dedupRecords++
+	if d.enableDiskLimitation {
+		d.totalDiskSpaceUsed += int64(len(record))
+	}
+
+	return nil
+}
+
+// compactDedup rewrites the dedup file with only the keys remembered
+func (d *diskQueue) compactDedup() error {
+	fileName := d.dedupFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	f, err := d.fs.OpenFile(tmpFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, entry := range d.dedupOrder {
+		buf.Write(encodeDedupEntry(entry))
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		d.fs.Remove(tmpFileName)
+		return err
+	}
+
+	// the old file is reopened on the next append if the rename fails
+	if d.dedupFile != nil {
+		d.dedupFile.Close()
+		d.dedupFile = nil
+	}
+
+	// atomically rename
+	err = d.fs.Rename(tmpFileName, fileName)
+	if err != nil {
+		f.Close()
+		d.fs.Remove(tmpFileName)
+		return err
+	}
+	d.dedupFile = f
+	d.dedupRecords = int64(len(d.dedupOrder))
+	d.dedupSize = int64(buf.Len())
+	d.replicateFile(fileName, buf.Bytes())
+
+	if d.enableDiskLimitation {
+		d.updateTotalDiskSpaceUsed()
+	}
+
+	return nil
+}
+
+// retrieveDedup rebuilds the remembered keys from the dedup file, dropping
+// a record that was only partially written by a crash
+func (d *diskQueue) retrieveDedup() error {
+	d.dedupKeys = make(map[string]int64)
+
+	f, err := d.fs.OpenFile(d.dedupFileName(), os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	scratch := make([]byte, 10)
+	for {
+		_, err = io.ReadFull(reader, scratch)
+		if err != nil {
+			break
+		}
+		key := make([]byte, binary.BigEndian.Uint16(scratch[8:]))
+		_, err = io.ReadFull(reader, key)
+		if err != nil {
+			break
+		}
+
+		// records are in the order the keys were put, so a key that
+		// was put again ends up with its latest time
+		entry := dedupEntry{key: string(key), seen: int64(binary.BigEndian.Uint64(scratch))}
+		d.dedupKeys[entry.key] = entry.seen
+		d.dedupOrder = append(d.dedupOrder, entry)
+	}
+	f.Close()
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	d.pruneDedup(time.Now().UnixNano())
+	// starts appending from a clean record boundary
+	return d.compactDedup()
+}
+
+func encodeDedupEntry(entry dedupEntry) []byte {
+	record := make([]byte, 10+len(entry.key))
+	binary.BigEndian.PutUint64(record, uint64(entry.seen))
+	binary.BigEndian.PutUint16(record[8:], uint16(len(entry.key)))
+	copy(record[10:], entry.key)
+	return record
+}
@@ -0,0 +1,162 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskQueuePutIdempotent(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_idempotent" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		DedupWindow:     time.Hour,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("1")))
+	// a retry is dropped
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("1")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("b", []byte("2")))
+	Nil(t, dq.Put([]byte("3")))
+	NotNil(t, dq.(IdempotentPutter).PutIdempotent("", []byte("4")))
+	// a message that fails to be written does not remember its key
+	NotNil(t, dq.(IdempotentPutter).PutIdempotent("c", make([]byte, 2<<10)))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("c", []byte("4")))
+	Equal(t, int64(4), dq.Depth())
+	dq.Close()
+
+	// keys are remembered across restarts, even once a record was torn
+	f, err := os.OpenFile(dq.(*diskQueue).dedupFileName(), os.O_WRONLY|os.O_APPEND, 0600)
+	Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	Nil(t, err)
+	f.Close()
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("1")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("c", []byte("4")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("d", []byte("5")))
+	Equal(t, int64(5), dq.Depth())
+	for i := 1; i <= 5; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	dq.Close()
+
+	// not available unless a window is set
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq.(IdempotentPutter).PutIdempotent("e", []byte("6")))
+	dq.Close()
+}
+
+func TestDiskQueuePutIdempotentWindow(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_idempotent_window" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1 << 20,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		DedupWindow:     100 * time.Millisecond,
+		DedupMaxKeys:    10,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	// keys are forgotten once the window has passed
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+	time.Sleep(150 * time.Millisecond)
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+	Equal(t, int64(2), dq.Depth())
+
+	// or when more than DedupMaxKeys were put since
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.(IdempotentPutter).PutIdempotent(strconv.Itoa(i), []byte("b")))
+	}
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("9", []byte("b")))
+	Equal(t, int64(13), dq.Depth())
+
+	// the key index stays bounded
+	for i := 0; i < 1000; i++ {
+		Nil(t, dq.(IdempotentPutter).PutIdempotent("key"+strconv.Itoa(i), nil))
+	}
+	dq.Close()
+	stat, err := os.Stat(dq.(*diskQueue).dedupFileName())
+	Nil(t, err)
+	Equal(t, true, stat.Size() <= int64(2*10*(10+len("key1000"))))
+
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Equal(t, 10, len(dq.(*diskQueue).dedupOrder))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("key999", nil))
+	Equal(t, int64(1013), dq.Depth())
+	dq.Close()
+}
+
+func TestDiskQueuePutIdempotentCompactionFS(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_put_idempotent_compaction_fs" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		DedupWindow:     time.Hour,
+		DedupMaxKeys:    2,
+		FS:              ffs,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	for i := 0; i < 4; i++ {
+		Nil(t, dq.(IdempotentPutter).PutIdempotent(strconv.Itoa(i), nil))
+	}
+
+	// a compaction that fails keeps the key file it was replacing
+	ffs.Inject(Fault{Op: OpRename, Path: ".dedup.dat", Times: 1, Err: syscall.EIO})
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("4", nil))
+	Equal(t, 1, ffs.Injected())
+	fileInfos, err := ioutil.ReadDir(tmpDir)
+	Nil(t, err)
+	for _, fileInfo := range fileInfos {
+		Equal(t, false, strings.HasSuffix(fileInfo.Name(), ".tmp"))
+	}
+
+	// and the next one persists the keys
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("5", nil))
+	dq.Close()
+
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("5", nil))
+	Equal(t, int64(6), dq.Depth())
+	dq.Close()
+}
@@ -0,0 +1,320 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+)
+
+// DelayedPutter is implemented by queues that can hold messages back
+// until a given time
+type DelayedPutter interface {
+	PutDelayed(data []byte, deliverAt time.Time) error
+}
+
+// delayedMsg locates a pending delayed frame in the delayed file
+type delayedMsg struct {
+	deliverAt int64
+	offset    int64
+	size      int64
+}
+
+// delayedHeap orders pending delayed messages by delivery time
+type delayedHeap []delayedMsg
+
+func (h delayedHeap) Len() int            { return len(h) }
+func (h delayedHeap) Less(i, j int) bool  { return h[i].deliverAt < h[j].deliverAt }
+func (h delayedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x interface{}) { *h = append(*h, x.(delayedMsg)) }
+func (h *delayedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// PutDelayed writes a []byte to the queue that only becomes readable
+// once deliverAt has passed
+//
+// the data is persisted right away and counts towards Depth(), when it is due
+// it is appended to the queue behind everything already written
+func (d *diskQueue) PutDelayed(data []byte, deliverAt time.Time) error {
+	return d.put(frame{data: data, deliverAt: deliverAt.UnixNano()})
+}
+
+func (d *diskQueue) delayedFileName() string {
+	return fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.delayed.dat"), d.name)
+}
+
+// retrieveDelayed rebuilds the pending delayed messages from the delayed file
+func (d *diskQueue) retrieveDelayed() error {
+	f, err := d.fs.OpenFile(d.delayedFileName(), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	var pos int64
+	for {
+		fr, totalBytes, err := d.readFrame(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a partially written frame at the end is dropped on the next compaction
+			d.logf(ERROR, "DISKQUEUE(%s) failed to read %s at %d - %s",
+				d.name, d.delayedFileName(), pos, err)
+			d.delayedDeadBytes += stat.Size() - pos
+			break
+		}
+
+		d.releaseFrame(fr)
+		if fr.promoted {
+			d.delayedDeadBytes += totalBytes
+		} else {
+			heap.Push(&d.delayed, delayedMsg{deliverAt: fr.deliverAt, offset: pos, size: totalBytes})
+			d.delayedLiveBytes += totalBytes
+		}
+		pos += totalBytes
+	}
+
+	return nil
+}
+
+// writeDelayed appends f to the delayed file
+func (d *diskQueue) writeDelayed(f frame) error {
+	var err error
+
+	dataLen := int32(len(f.data))
+	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
+		return fmt.Errorf("%w (%d) minMsgSize=%d maxMsgSize=%d", ErrMsgSize, dataLen, d.minMsgSize, d.maxMsgSize)
+	}
+
+	err = d.openDelayedFile()
+	if err != nil {
+		return err
+	}
+
+	flags := d.frameFlags(&f)
+	headers := encodeHeaders(f.headers)
+	totalBytes := int64(4+frameHeaderSize(flags)+dataLen) + int64(len(headers))
+
+	if d.enableDiskLimitation {
+		err = d.checkDiskSpace(totalBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.writeBuf.Reset()
+	d.writeFrameHeader(flags, f, headers)
+	d.writeBuf.Write(f.data)
+
+	offset := d.delayedLiveBytes + d.delayedDeadBytes
+	_, err = d.delayedFile.WriteAt(d.writeBuf.Bytes(), offset)
+	if err != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+		return err
+	}
+	d.replicateWrite(d.delayedFileName(), offset, d.writeBuf.Bytes())
+
+	heap.Push(&d.delayed, delayedMsg{deliverAt: f.deliverAt, offset: offset, size: totalBytes})
+	d.delayedLiveBytes += totalBytes
+	if d.enableDiskLimitation {
+		d.totalDiskSpaceUsed += totalBytes
+	}
+
+	return nil
+}
+
+func (d *diskQueue) openDelayedFile() error {
+	var err error
+
+	if d.delayedFile == nil {
+		d.delayedFile, err = d.fs.OpenFile(d.delayedFileName(), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		d.logf(INFO, "DISKQUEUE(%s): opened %s", d.name, d.delayedFileName())
+	}
+
+	return nil
+}
+
+// promoteDelayed appends every delayed message that is due to the queue
+// and marks it as promoted in the delayed file
+//
+// a crash between the two steps delivers the message twice
+func (d *diskQueue) promoteDelayed(now int64) error {
+	if len(d.delayed) == 0 || d.delayed[0].deliverAt > now {
+		return nil
+	}
+
+	err := d.openDelayedFile()
+	if err != nil {
+		return err
+	}
+
+	for len(d.delayed) > 0 && d.delayed[0].deliverAt <= now {
+		msg := d.delayed[0]
+
+		buf := make([]byte, msg.size)
+		_, err = d.delayedFile.ReadAt(buf, msg.offset)
+		if err != nil {
+			return err
+		}
+
+		fr, _, err := d.readFrame(bytes.NewReader(buf))
+		if err != nil {
+			// nothing can be recovered from a corrupt frame
+			d.logf(ERROR, "DISKQUEUE(%s) dropping delayed message at %d of %s - %s",
+				d.name, msg.offset, d.delayedFileName(), err)
+		} else {
+			fr.deliverAt = 0
+			err = d.writeOne(fr)
+			d.releaseFrame(fr)
+			if err != nil {
+				return err
+			}
+		}
+
+		// flip the promoted flag in place, the flags byte follows the length prefix
+		flags := []byte{buf[4] | frameFlagPromoted}
+		_, err = d.delayedFile.WriteAt(flags, msg.offset+4)
+		if err != nil {
+			// the message was written, it is promoted again after a restart
+			d.logf(ERROR, "DISKQUEUE(%s) failed to flag promoted message at %d of %s - %s",
+				d.name, msg.offset, d.delayedFileName(), err)
+		} else {
+			d.replicateWrite(d.delayedFileName(), msg.offset+4, flags)
+		}
+
+		heap.Pop(&d.delayed)
+		d.delayedLiveBytes -= msg.size
+		d.delayedDeadBytes += msg.size
+		d.needSync = true
+	}
+
+	return d.compactDelayed()
+}
+
+// compactDelayed drops promoted messages from the delayed file once they
+// take up more space than the pending ones
+func (d *diskQueue) compactDelayed() error {
+	if len(d.delayed) == 0 {
+		return d.removeDelayed()
+	}
+
+	if d.delayedDeadBytes <= d.delayedLiveBytes || d.delayedDeadBytes < d.maxBytesPerFile {
+		return nil
+	}
+
+	err := d.openDelayedFile()
+	if err != nil {
+		return err
+	}
+
+	fileName := d.delayedFileName()
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	f, err := d.fs.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	var pos int64
+	compacted := make(delayedHeap, 0, len(d.delayed))
+	for _, msg := range d.delayed {
+		buf := make([]byte, msg.size)
+		_, err = d.delayedFile.ReadAt(buf, msg.offset)
+		if err == nil {
+			_, err = f.WriteAt(buf, pos)
+		}
+		if err != nil {
+			f.Close()
+			d.fs.Remove(tmpFileName)
+			return err
+		}
+		compacted = append(compacted, delayedMsg{deliverAt: msg.deliverAt, offset: pos, size: msg.size})
+		pos += msg.size
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		d.fs.Remove(tmpFileName)
+		return err
+	}
+
+	// the old file is reopened on its next use if the rename fails
+	d.delayedFile.Close()
+	d.delayedFile = nil
+
+	// atomically rename
+	err = d.fs.Rename(tmpFileName, fileName)
+	if err != nil {
+		f.Close()
+		d.fs.Remove(tmpFileName)
+		return err
+	}
+	d.delayedFile = f
+	if len(d.replication.replicas) > 0 {
+		data, err := readFile(d.fs, fileName)
+		if err == nil {
+			d.replicateFile(fileName, data)
+		}
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s) compacted %s from %d to %d bytes",
+		d.name, fileName, d.delayedLiveBytes+d.delayedDeadBytes, pos)
+
+	// keeps the heap ordering since only offsets changed
+	d.delayed = compacted
+	d.delayedDeadBytes = 0
+	if d.enableDiskLimitation {
+		d.updateTotalDiskSpaceUsed()
+	}
+
+	return nil
+}
+
+// removeDelayed deletes the delayed file along with anything pending in it
+func (d *diskQueue) removeDelayed() error {
+	if d.delayedFile != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+	}
+
+	d.delayed = d.delayed[:0]
+	d.delayedLiveBytes = 0
+	d.delayedDeadBytes = 0
+
+	err := d.fs.Remove(d.delayedFileName())
+	if err != nil && !os.IsNotExist(err) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to remove delayed file - %s", d.name, err)
+		return err
+	}
+	if err == nil {
+		d.replicateRemove(d.delayedFileName())
+	}
+
+	if d.enableDiskLimitation {
+		d.updateTotalDiskSpaceUsed()
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueDelayed(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("later"), time.Now().Add(100*time.Millisecond)))
+	Nil(t, dq.Put([]byte("now")))
+	// a time in the past is the same as Put
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("past"), time.Now().Add(-time.Second)))
+	Equal(t, int64(3), dq.Depth())
+
+	// ready messages are not held up by the delayed one
+	Equal(t, []byte("now"), <-dq.ReadChan())
+	Equal(t, []byte("past"), <-dq.ReadChan())
+	Equal(t, int64(1), dq.Depth())
+
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("delayed message delivered early")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	start := time.Now()
+	Equal(t, []byte("later"), <-dq.ReadChan())
+	Equal(t, true, time.Since(start) > 50*time.Millisecond)
+	Equal(t, int64(0), dq.Depth())
+
+	// the delayed file is removed once nothing is pending in it
+	assertFileNotExist(t, dq.(*diskQueue).delayedFileName())
+}
+
+func TestDiskQueueDelayedRestart(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed_restart" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	deliverAt := time.Now().Add(200 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.(DelayedPutter).PutDelayed([]byte{byte(i)}, deliverAt.Add(time.Duration(i)*time.Millisecond)))
+	}
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("much later"), time.Now().Add(time.Hour)))
+	Equal(t, int64(11), dq.Depth())
+	dq.Close()
+
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, int64(11), dq.Depth())
+
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), dq.Depth())
+
+	// promoted messages are not delivered again after a restart
+	dq.Close()
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, int64(1), dq.Depth())
+
+	Nil(t, dq.Empty())
+	Equal(t, int64(0), dq.Depth())
+	assertFileNotExist(t, dq.(*diskQueue).delayedFileName())
+	dq.Close()
+}
+
+func TestDiskQueueDelayedCompaction(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed_compaction" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	msg := make([]byte, 10)
+	// 23 bytes per delayed message
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.(DelayedPutter).PutDelayed(msg, time.Now().Add(50*time.Millisecond)))
+	}
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("much later"), time.Now().Add(time.Hour)))
+
+	for i := 0; i < 10; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), dq.Depth())
+
+	// only the pending message is left in the delayed file
+	stat, err := os.Stat(dq.(*diskQueue).delayedFileName())
+	Nil(t, err)
+	Equal(t, int64(23), stat.Size())
+}
+
+func TestDiskQueueDelayedCompactionFS(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed_compaction_fs" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	msg := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.(DelayedPutter).PutDelayed(msg, time.Now().Add(50*time.Millisecond)))
+	}
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("much later"), time.Now().Add(time.Hour)))
+
+	// a promoted flag that cannot be written does not hold back the other
+	// messages, and a failed compaction keeps the delayed file
+	ffs.Inject(Fault{Op: OpWrite, Path: ".delayed.dat", Times: 1, Err: syscall.EIO})
+	ffs.Inject(Fault{Op: OpRename, Path: ".delayed.dat", Times: 1, Err: syscall.EIO})
+	for i := 0; i < 10; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, 2, ffs.Injected())
+
+	fileInfos, err := ioutil.ReadDir(tmpDir)
+	Nil(t, err)
+	for _, fileInfo := range fileInfos {
+		Equal(t, false, strings.HasSuffix(fileInfo.Name(), ".tmp"))
+	}
+	_, err = os.Stat(dq.(*diskQueue).delayedFileName())
+	Nil(t, err)
+
+	// the delayed file is reopened by the next write
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("soon"), time.Now()))
+	Equal(t, []byte("soon"), <-dq.ReadChan())
+}
+
+func TestDiskQueueDelayedMaxMsgAge(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed_max_msg_age" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	expired := make(chan []byte, 1)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxMsgAge:       200 * time.Millisecond,
+		OnExpire:        func(data []byte) { expired <- data },
+	}, l)
+	NotNil(t, dq)
+
+	// its age counts from when it was put rather than from when it was due
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("later"), time.Now().Add(150*time.Millisecond)))
+	time.Sleep(250 * time.Millisecond)
+	Nil(t, dq.Put([]byte("now")))
+	Equal(t, []byte("now"), <-dq.ReadChan())
+	Equal(t, []byte("later"), <-expired)
+	dq.Close()
+}
+
+func TestDiskQueueDelayedFullReject(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_delayed_full_reject" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesDiskSpace: 6040,
+		MaxBytesPerFile:   1 << 11,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		FullPolicy:        FullReject,
+	}, l)
+	NotNil(t, dq)
+
+	msg := make([]byte, 1000)
+	for i := 0; i < 4; i++ {
+		msg[0] = byte(i)
+		Nil(t, dq.Put(msg))
+	}
+	msg[0] = 4
+	Nil(t, dq.(DelayedPutter).PutDelayed(msg, time.Now().Add(20*time.Millisecond)))
+	time.Sleep(50 * time.Millisecond)
+	// there is no space to append the due message, so it stays pending
+	Equal(t, int64(5), dq.Depth())
+	_, err = os.Stat(dq.(*diskQueue).delayedFileName())
+	Nil(t, err)
+
+	// and is delivered once the first file was read
+	for i := 0; i < 5; i++ {
+		msg[0] = byte(i)
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+	dq.Close()
+}
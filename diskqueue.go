@@ -7,8 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"os"
 	"path"
 	"regexp"
@@ -30,8 +31,6 @@ const (
 	maxMetaDataFileSize = 56
 )
 
-var badFileNameRegexp, fileNameRegexp *regexp.Regexp
-
 type AppLogFunc func(lvl LogLevel, f string, args ...interface{})
 
 func (l LogLevel) String() string {
@@ -61,6 +60,88 @@ type Interface interface {
 	TotalBytesFolderSize() int64
 }
 
+// Rewinder is implemented by queues that retain consumed data and can move
+// their read position back in time
+type Rewinder interface {
+	RewindTo(t time.Time) error
+}
+
+// TTLPutter is implemented by queues that can drop messages which were not
+// read before they expired
+type TTLPutter interface {
+	PutWithTTL(data []byte, ttl time.Duration) error
+}
+
+// Options holds the instantiation time parameters used by NewWithOptions
+//
+// MaxBytesDiskSpace, RetentionPeriod and RetentionBytes are optional and
+// the features they control are disabled when left at zero
+type Options struct {
+	MaxBytesDiskSpace int64
+	MaxBytesPerFile   int64
+	MinMsgSize        int32
+	MaxMsgSize        int32
+	SyncEvery         int64         // number of writes per fsync
+	SyncTimeout       time.Duration // duration of time per fsync
+
+	// consumed files are kept (rather than deleted) while they are younger
+	// than RetentionPeriod and the retained files fit within RetentionBytes
+	RetentionPeriod time.Duration
+	RetentionBytes  int64
+
+	// messages older than MaxMsgAge, or past the TTL given to PutWithTTL,
+	// are skipped on read and handed to OnExpire instead
+	MaxMsgAge time.Duration
+	OnExpire  func(data []byte)
+
+	// complete files are read through a read-only memory mapping rather than
+	// buffered reads, falling back to the latter if mapping a file fails
+	MmapReads bool
+
+	// number of messages decoded ahead of the read position in the background,
+	// by default each message is read from disk by ioLoop when it is needed
+	ReadAhead int
+
+	// decoded messages are backed by size classed buffers that are recycled
+	// when messages received from MessageChan() are released
+	PoolBuffers bool
+
+	// each new file is allocated up to MaxBytesPerFile when it is opened,
+	// and truncated to the size of its data when it is rolled
+	Preallocate bool
+
+	// while the queue has followers (see Replicator), Put() waits until
+	// ReplicaAcks of them applied and synced the message, for up to
+	// ReplicaAckTimeout (SyncTimeout by default), and returns ErrReplicaAcks
+	// if they did not, without a follower it does not wait
+	ReplicaAcks       int
+	ReplicaAckTimeout time.Duration
+
+	// PutIdempotent() drops messages whose key was put within DedupWindow,
+	// remembering up to DedupMaxKeys keys (65536 by default)
+	DedupWindow  time.Duration
+	DedupMaxKeys int
+
+	// at most MaxDepth messages are pending, delayed ones included, and
+	// FullPolicy decides what happens to a write once they are, or once
+	// MaxBytesDiskSpace is reached (FullEvictOldest by default)
+	MaxDepth   int64
+	FullPolicy FullPolicy
+
+	// OnWatermark is called by the queue's goroutine each time one of
+	// Watermarks is crossed, and must not call the queue back
+	Watermarks  []Watermark
+	OnWatermark func(WatermarkEvent)
+
+	// the file system the files are stored in, the operating system's
+	// by default (e.g. a FaultFS in tests)
+	FS FS
+
+	// the disk space used by every queue sharing MaxBytesDiskSpace, e.g. the
+	// shards of a ShardedQueue, see publishUsage()
+	sharedUsage *int64
+}
+
 // diskQueue implements a filesystem backed FIFO queue
 type diskQueue struct {
 	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
@@ -79,6 +160,8 @@ type diskQueue struct {
 
 	// instantiation time metadata
 	name                string
+	fileNameRegexp      *regexp.Regexp
+	badFileNameRegexp   *regexp.Regexp
 	dataPath            string
 	maxBytesDiskSpace   int64
 	maxBytesPerFile     int64 // cannot change once created
@@ -87,7 +170,25 @@ type diskQueue struct {
 	maxMsgSize          int32
 	syncEvery           int64         // number of writes per fsync
 	syncTimeout         time.Duration // duration of time per fsync
-	exitFlag            int32
+	retentionPeriod     time.Duration
+	retentionBytes      int64
+	maxMsgAge           time.Duration
+	onExpire            func([]byte)
+	mmapReads           bool
+	preallocateFiles    bool
+	readAheadSize       int
+	replicaAcks         int
+	replicaAckTimeout   time.Duration
+	dedupWindow         time.Duration
+	dedupMaxKeys        int
+	maxDepth            int64
+	fullPolicy          FullPolicy
+	watermarks          []watermarkState
+	onWatermark         func(WatermarkEvent)
+	state               int32
+	fs                  FS
+	sharedUsage         *int64
+	publishedUsage      int64 // the part of sharedUsage added by this queue
 	needSync            bool
 
 	// keeps track of the position where we have read
@@ -95,30 +196,103 @@ type diskQueue struct {
 	nextReadPos     int64
 	nextReadFileNum int64
 
-	readFile  *os.File
-	writeFile *os.File
-	reader    *bufio.Reader
+	readFile  File
+	writeFile File
+	reader    io.Reader
+	readMmap  []byte // mapping of readFile, when reading a complete file with mmap
 	writeBuf  bytes.Buffer
 
+	// bytes preallocated past writePos in writeFile, they are accounted for in
+	// totalDiskSpaceUsed as soon as they are reserved
+	writeFileReserved int64
+
+	// bytes staged by the open transactions, accounted for in
+	// totalDiskSpaceUsed until they are committed or rolled back
+	txStaged int64
+	// set while a transaction is appended, which made room for all of its
+	// messages beforehand
+	applyingTx bool
+
+	// decodes messages in the background when readAheadSize > 0
+	readAhead *readAhead
+
+	// recycles message buffers, nil unless PoolBuffers is set
+	bufPool *bufferPool
+
+	// followers everything written is streamed to
+	replication *replicaSet
+
+	// messages held back by PutDelayed()
+	delayedFile      File
+	delayed          delayedHeap
+	delayedLiveBytes int64
+	delayedDeadBytes int64
+
+	// keys of the messages put by PutIdempotent() within dedupWindow
+	dedupFile    File
+	dedupKeys    map[string]int64
+	dedupOrder   []dedupEntry
+	dedupRecords int64 // in dedupFile, including the ones of pruned keys
+	dedupSize    int64 // of dedupFile, where the next record is appended
+
+	// closed to wake up the writers blocked by FullBlock
+	freedMtx  sync.Mutex
+	freedChan chan int
+
 	// exposed via ReadChan()
 	readChan chan []byte
 
 	// exposed via PeekChan()
 	peekChan chan []byte
 
+	// exposed via MessageChan()
+	messageChan chan Message
+
+	// the queues built on diskQueue peek through headChan and take()
+	headChan chan head
+
 	// internal channels
-	depthChan         chan int64
-	writeChan         chan []byte
-	writeResponseChan chan error
-	emptyChan         chan int
-	emptyResponseChan chan error
-	exitChan          chan int
-	exitSyncChan      chan int
+	depthChan          chan int64
+	writeChan          chan frame
+	writeResponseChan  chan error
+	emptyChan          chan int
+	emptyResponseChan  chan error
+	rewindChan         chan time.Time
+	rewindResponseChan chan error
+	usageChan          chan int64
+	evictChan          chan int
+	evictResponseChan  chan error
+	followChan         chan net.Conn
+	followResponseChan chan error
+	scanChan           chan int
+	scanResponseChan   chan scanSnapshot
+	commitChan         chan *Tx
+	commitResponseChan chan error
+	stageChan          chan int64
+	stageResponseChan  chan error
+	appendChan         chan transferAppend
+	appendResponseChan chan error
+	skipChan           chan Position
+	skipResponseChan   chan error
+	takeChan           chan Position
+	takeResponseChan   chan error
+	exitChan           chan int
+	exitSyncChan       chan int
+
+	// exposed via Done()
+	doneChan chan struct{}
 
 	logf AppLogFunc
 
 	// disk limit implementation flag
 	enableDiskLimitation bool
+
+	// retention implementation flag
+	enableRetention bool
+
+	// the oldest consumed file that may still be kept on disk,
+	// equal to readFileNum when nothing is retained
+	retainedFileNum int64
 }
 
 // New instantiates an instance of diskQueue, retrieving metadata
@@ -140,30 +314,96 @@ func NewWithDiskSpace(name string, dataPath string,
 	maxBytesDiskSpace int64, maxBytesPerFile int64,
 	minMsgSize int32, maxMsgSize int32,
 	syncEvery int64, syncTimeout time.Duration, logf AppLogFunc) Interface {
-	enableDiskLimitation := true
-	if maxBytesDiskSpace <= 0 {
-		enableDiskLimitation = false
-	}
+
+	return NewWithOptions(name, dataPath, Options{
+		MaxBytesDiskSpace: maxBytesDiskSpace,
+		MaxBytesPerFile:   maxBytesPerFile,
+		MinMsgSize:        minMsgSize,
+		MaxMsgSize:        maxMsgSize,
+		SyncEvery:         syncEvery,
+		SyncTimeout:       syncTimeout,
+	}, logf)
+}
+
+// NewWithOptions instantiates an instance of diskQueue with every
+// optional feature configurable through Options
+func NewWithOptions(name string, dataPath string, opts Options, logf AppLogFunc) Interface {
 	d := diskQueue{
 		name:                 name,
 		dataPath:             dataPath,
-		maxBytesDiskSpace:    maxBytesDiskSpace,
-		maxBytesPerFile:      maxBytesPerFile,
-		minMsgSize:           minMsgSize,
-		maxMsgSize:           maxMsgSize,
+		maxBytesDiskSpace:    opts.MaxBytesDiskSpace,
+		maxBytesPerFile:      opts.MaxBytesPerFile,
+		minMsgSize:           opts.MinMsgSize,
+		maxMsgSize:           opts.MaxMsgSize,
 		readChan:             make(chan []byte),
 		peekChan:             make(chan []byte),
+		messageChan:          make(chan Message),
+		headChan:             make(chan head),
 		depthChan:            make(chan int64),
-		writeChan:            make(chan []byte),
+		writeChan:            make(chan frame),
 		writeResponseChan:    make(chan error),
 		emptyChan:            make(chan int),
 		emptyResponseChan:    make(chan error),
+		rewindChan:           make(chan time.Time),
+		rewindResponseChan:   make(chan error),
+		usageChan:            make(chan int64),
+		evictChan:            make(chan int),
+		evictResponseChan:    make(chan error),
+		followChan:           make(chan net.Conn),
+		followResponseChan:   make(chan error),
+		scanChan:             make(chan int),
+		scanResponseChan:     make(chan scanSnapshot),
+		commitChan:           make(chan *Tx),
+		commitResponseChan:   make(chan error),
+		stageChan:            make(chan int64),
+		stageResponseChan:    make(chan error),
+		appendChan:           make(chan transferAppend),
+		appendResponseChan:   make(chan error),
+		skipChan:             make(chan Position),
+		skipResponseChan:     make(chan error),
+		takeChan:             make(chan Position),
+		takeResponseChan:     make(chan error),
 		exitChan:             make(chan int),
 		exitSyncChan:         make(chan int),
-		syncEvery:            syncEvery,
-		syncTimeout:          syncTimeout,
+		doneChan:             make(chan struct{}),
+		fs:                   opts.FS,
+		sharedUsage:          opts.sharedUsage,
+		syncEvery:            opts.SyncEvery,
+		syncTimeout:          opts.SyncTimeout,
+		retentionPeriod:      opts.RetentionPeriod,
+		retentionBytes:       opts.RetentionBytes,
+		maxMsgAge:            opts.MaxMsgAge,
+		onExpire:             opts.OnExpire,
+		mmapReads:            opts.MmapReads,
+		preallocateFiles:     opts.Preallocate,
+		readAheadSize:        opts.ReadAhead,
+		replicaAcks:          opts.ReplicaAcks,
+		replicaAckTimeout:    opts.ReplicaAckTimeout,
+		dedupWindow:          opts.DedupWindow,
+		dedupMaxKeys:         opts.DedupMaxKeys,
+		maxDepth:             opts.MaxDepth,
+		fullPolicy:           opts.FullPolicy,
+		onWatermark:          opts.OnWatermark,
+		replication:          newReplicaSet(),
 		logf:                 logf,
-		enableDiskLimitation: enableDiskLimitation,
+		enableDiskLimitation: opts.MaxBytesDiskSpace > 0,
+		enableRetention:      opts.RetentionPeriod > 0 || opts.RetentionBytes > 0,
+	}
+
+	if d.replicaAckTimeout == 0 {
+		d.replicaAckTimeout = d.syncTimeout
+	}
+
+	if d.fs == nil {
+		d.fs = OSFS{}
+	}
+
+	for _, w := range opts.Watermarks {
+		d.watermarks = append(d.watermarks, watermarkState{Watermark: w})
+	}
+
+	if opts.PoolBuffers {
+		d.bufPool = newBufferPool(d.minMsgSize, d.maxMsgSize)
 	}
 
 	err := d.start()
@@ -185,17 +425,57 @@ func (d *diskQueue) start() error {
 		return errors.New(errorMsg)
 	}
 
+	err := d.checkWatermarks()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) - %s", d.name, err)
+		return err
+	}
+
 	// no need to lock here, nothing else could possibly be touching this instance
-	err := d.retrieveMetaData()
+	err = d.retrieveMetaData()
 	if err != nil && !os.IsNotExist(err) {
 		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieveMetaData - %s", d.name, err)
+	} else if err == nil {
+		err = d.trimWriteFile()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to trim the write file - %s", d.name, err)
+		}
 	}
 
-	fileNameRegexp = regexp.MustCompile(`^` + d.name + `.diskqueue.\d+.dat$`)
-	badFileNameRegexp = regexp.MustCompile(`^` + d.name + `.diskqueue.\d+.dat.bad$`)
+	d.fileNameRegexp = regexp.MustCompile(`^` + regexp.QuoteMeta(d.name) + `\.diskqueue\.\d+\.dat$`)
+	d.badFileNameRegexp = regexp.MustCompile(`^` + regexp.QuoteMeta(d.name) + `\.diskqueue\.\d+\.dat\.bad$`)
 
 	d.updateTotalDiskSpaceUsed()
 
+	if d.enableRetention {
+		d.findRetainedFiles()
+		d.pruneRetainedFiles()
+	} else {
+		d.retainedFileNum = d.readFileNum
+	}
+
+	err = d.retrieveDelayed()
+	if err == nil {
+		err = d.compactDelayed()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieve delayed messages - %s", d.name, err)
+	}
+
+	if d.dedupWindow > 0 {
+		err = d.retrieveDedup()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to retrieve idempotency keys - %s", d.name, err)
+		}
+	}
+
+	err = d.recoverTxs()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to recover transactions - %s", d.name, err)
+	}
+
+	d.publishUsage()
+
 	go d.ioLoop()
 
 	return nil
@@ -210,7 +490,7 @@ func (d *diskQueue) Depth() int64 {
 	depth, ok := <-d.depthChan
 	if !ok {
 		// ioLoop exited
-		depth = d.depth
+		depth = d.depth + int64(len(d.delayed))
 	}
 	return depth
 }
@@ -234,37 +514,99 @@ func (d *diskQueue) ReadChan() <-chan []byte {
 	return d.readChan
 }
 
+// MessageChan returns the receive-only Message channel for reading data
+// whose buffers can be released for reuse
+func (d *diskQueue) MessageChan() <-chan Message {
+	return d.messageChan
+}
+
 // Put writes a []byte to the queue
 func (d *diskQueue) Put(data []byte) error {
-	d.RLock()
-	defer d.RUnlock()
+	return d.put(frame{data: data})
+}
+
+// PutWithTTL writes a []byte to the queue that is dropped instead of
+// being read once ttl has passed
+func (d *diskQueue) PutWithTTL(data []byte, ttl time.Duration) error {
+	return d.put(frame{data: data, expiry: time.Now().Add(ttl).UnixNano()})
+}
+
+func (d *diskQueue) put(f frame) error {
+	return d.putFrame(f, d.fullPolicy == FullBlock)
+}
+
+// putFrame writes f, waiting for readers to make room when block is set and
+// the queue is full
+func (d *diskQueue) putFrame(f frame, block bool) error {
+	var err error
+	for {
+		var freed chan int
+		if block {
+			// taken before writing, so that space freed in between is not missed
+			freed = d.freed()
+		}
+
+		d.RLock()
+
+		if d.state != stateOpen {
+			d.RUnlock()
+			return ErrClosed
+		}
+
+		d.writeChan <- f
+		err = <-d.writeResponseChan
+		d.RUnlock()
 
-	if d.exitFlag == 1 {
-		return errors.New("exiting")
+		if freed == nil || !(errors.Is(err, ErrQueueFull) || errors.Is(err, ErrDiskFull)) {
+			break
+		}
+		select {
+		case <-freed:
+		case <-d.exitChan:
+			return ErrClosed
+		}
 	}
 
-	d.writeChan <- data
-	return <-d.writeResponseChan
+	if err != nil || d.replicaAcks == 0 {
+		return err
+	}
+	// not holding the lock, so that Close() does not have to wait for acks
+	return d.waitReplicaAcks()
 }
 
-// Close cleans up the queue and persists metadata
+// Close cleans up the queue and persists metadata, it does nothing once the
+// queue was closed
 func (d *diskQueue) Close() error {
-	err := d.exit(false)
-	if err != nil {
-		return err
+	if !d.exit(false) {
+		return nil
 	}
-	return d.sync()
+	err := d.sync()
+	// followers receive the metadata persisted by sync
+	d.closeReplicas()
+	close(d.doneChan)
+	return err
 }
 
+// Delete cleans up the queue without persisting metadata, its files are
+// left behind (see Destroy). It does nothing once the queue was closed
 func (d *diskQueue) Delete() error {
-	return d.exit(true)
+	if d.exit(true) {
+		d.closeReplicas()
+		close(d.doneChan)
+	}
+	return nil
 }
 
-func (d *diskQueue) exit(deleted bool) error {
+// exit stops ioLoop and closes the files, it returns false when the queue
+// was already closed
+func (d *diskQueue) exit(deleted bool) bool {
 	d.Lock()
 	defer d.Unlock()
 
-	d.exitFlag = 1
+	if d.state != stateOpen {
+		return false
+	}
+	d.state = stateClosed
 
 	if deleted {
 		d.logf(INFO, "DISKQUEUE(%s): deleting", d.name)
@@ -279,8 +621,7 @@ func (d *diskQueue) exit(deleted bool) error {
 	close(d.depthChan)
 
 	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+		d.closeReadFile()
 	}
 
 	if d.writeFile != nil {
@@ -288,7 +629,17 @@ func (d *diskQueue) exit(deleted bool) error {
 		d.writeFile = nil
 	}
 
-	return nil
+	if d.delayedFile != nil {
+		d.delayedFile.Close()
+		d.delayedFile = nil
+	}
+
+	if d.dedupFile != nil {
+		d.dedupFile.Close()
+		d.dedupFile = nil
+	}
+
+	return true
 }
 
 // Empty destructively clears out any pending data in the queue
@@ -297,8 +648,8 @@ func (d *diskQueue) Empty() error {
 	d.RLock()
 	defer d.RUnlock()
 
-	if d.exitFlag == 1 {
-		return errors.New("exiting")
+	if d.state != stateOpen {
+		return ErrClosed
 	}
 
 	d.logf(INFO, "DISKQUEUE(%s): emptying", d.name)
@@ -307,14 +658,48 @@ func (d *diskQueue) Empty() error {
 	return <-d.emptyResponseChan
 }
 
+// RewindTo moves the read position back to the first retained message
+// written at or after t, making every message from there on pending again
+func (d *diskQueue) RewindTo(t time.Time) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.state != stateOpen {
+		return ErrClosed
+	}
+
+	if !d.enableRetention {
+		return ErrRetentionDisabled
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s): rewinding to %s", d.name, t)
+
+	d.rewindChan <- t
+	return <-d.rewindResponseChan
+}
+
 func (d *diskQueue) deleteAllFiles() error {
+	var retainedErr error
+	if d.enableRetention {
+		retainedErr = d.removeRetainedFiles()
+	}
+
+	delayedErr := d.removeDelayed()
+
 	err := d.skipToNextRWFile()
+	if err == nil {
+		err = retainedErr
+	}
+	if err == nil {
+		err = delayedErr
+	}
 
-	innerErr := os.Remove(d.metaDataFileName())
+	innerErr := d.fs.Remove(d.metaDataFileName())
 	if innerErr != nil && !os.IsNotExist(innerErr) {
 		d.logf(ERROR, "DISKQUEUE(%s) failed to remove metadata file - %s", d.name, innerErr)
 		return innerErr
 	}
+	d.replicateRemove(d.metaDataFileName())
 
 	return err
 }
@@ -323,8 +708,7 @@ func (d *diskQueue) skipToNextRWFile() error {
 	var err error
 
 	if d.readFile != nil {
-		d.readFile.Close()
-		d.readFile = nil
+		d.closeReadFile()
 	}
 
 	if d.writeFile != nil {
@@ -334,15 +718,21 @@ func (d *diskQueue) skipToNextRWFile() error {
 
 	for i := d.readFileNum; i <= d.writeFileNum; i++ {
 		fn := d.fileName(i)
-		innerErr := os.Remove(fn)
+		innerErr := d.fs.Remove(fn)
 		if innerErr != nil && !os.IsNotExist(innerErr) {
 			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, innerErr)
 			err = innerErr
+		} else {
+			d.replicateRemove(fn)
 		}
 	}
 
 	d.writeFileNum++
 	d.writePos = 0
+	d.writeFileReserved = 0
+	if d.retainedFileNum == d.readFileNum {
+		d.retainedFileNum = d.writeFileNum
+	}
 	d.readFileNum = d.writeFileNum
 	d.readPos = 0
 	d.nextReadFileNum = d.writeFileNum
@@ -360,70 +750,46 @@ func (d *diskQueue) skipToNextRWFile() error {
 
 // readOne performs a low level filesystem read for a single []byte
 // while advancing read positions and rolling files, if necessary
-func (d *diskQueue) readOne() ([]byte, error) {
+func (d *diskQueue) readOne() (frame, error) {
 	var err error
-	var msgSize int32
 
 	if d.readFile == nil {
-		curFileName := d.fileName(d.readFileNum)
-		d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+		var end int64
+		d.readFile, d.readMmap, end, err = d.openReadFile(d.readFileNum, d.readPos,
+			d.readFileNum < d.writeFileNum)
 		if err != nil {
-			return nil, err
+			return frame{}, err
 		}
 
-		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, curFileName)
-
-		if d.readPos > 0 {
-			_, err = d.readFile.Seek(d.readPos, 0)
-			if err != nil {
-				d.readFile.Close()
-				d.readFile = nil
-				return nil, err
-			}
-		}
+		d.logf(INFO, "DISKQUEUE(%s): readOne() opened %s", d.name, d.readFile.Name())
 
 		// for "complete" files (i.e. not the "current" file), maxBytesPerFileRead
 		// should be initialized to the file's size, or default to maxBytesPerFile
 		d.maxBytesPerFileRead = d.maxBytesPerFile
-		if d.readFileNum < d.writeFileNum {
-			stat, err := d.readFile.Stat()
-			if err == nil {
-				d.maxBytesPerFileRead = stat.Size()
-				if d.enableDiskLimitation {
-					// last 8 bytes are reserved for the number of messages in this file
-					d.maxBytesPerFileRead -= numFileMsgBytes
+		if end >= 0 {
+			d.maxBytesPerFileRead = end
+		}
+
+		var limit func() int64
+		if d.preallocateFiles && end < 0 {
+			fileNum := d.readFileNum
+			limit = func() int64 {
+				if fileNum < d.writeFileNum {
+					// trimmed when it was rolled
+					return math.MaxInt64
 				}
+				return d.writePos
 			}
 		}
-
-		d.reader = bufio.NewReader(d.readFile)
-	}
-
-	err = binary.Read(d.reader, binary.BigEndian, &msgSize)
-	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
-	}
-
-	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
-		// this file is corrupt and we have no reasonable guarantee on
-		// where a new message should begin
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
+		d.reader = newFileReader(d.readFile, d.readMmap, d.readPos, limit)
 	}
 
-	readBuf := make([]byte, msgSize)
-	_, err = io.ReadFull(d.reader, readBuf)
+	f, totalBytes, err := d.readFrame(d.reader)
 	if err != nil {
-		d.readFile.Close()
-		d.readFile = nil
-		return nil, err
+		d.closeReadFile()
+		return f, err
 	}
 
-	totalBytes := int64(4 + msgSize)
-
 	// we only advance next* because we have not yet sent this to consumers
 	// (where readFileNum, readPos will actually be advanced)
 	d.nextReadPos = d.readPos + totalBytes
@@ -434,15 +800,297 @@ func (d *diskQueue) readOne() ([]byte, error) {
 	// rely on maxBytesPerFileRead rather than maxBytesPerFile
 	if d.readFileNum < d.writeFileNum && d.nextReadPos >= d.maxBytesPerFileRead {
 		if d.readFile != nil {
-			d.readFile.Close()
-			d.readFile = nil
+			d.closeReadFile()
 		}
 
 		d.nextReadFileNum++
 		d.nextReadPos = 0
 	}
 
-	return readBuf, nil
+	return f, nil
+}
+
+// openReadFile opens a data file for reading from pos
+//
+// a complete file is mapped into memory when mmapReads is set, and the
+// returned end is the offset at which its messages end. end is -1 for the
+// "current" file or when the size is unknown
+func (d *diskQueue) openReadFile(fileNum int64, pos int64, complete bool) (File, []byte, int64, error) {
+	fileName := d.fileName(fileNum)
+	f, err := d.fs.OpenFile(fileName, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	if pos > 0 {
+		_, err = f.Seek(pos, 0)
+		if err != nil {
+			f.Close()
+			return nil, nil, -1, err
+		}
+	}
+
+	end := int64(-1)
+	var mapping []byte
+	if complete {
+		dataEnd, err := d.dataEnd(f)
+		if err == nil {
+			end = dataEnd
+
+			// a complete file no longer changes so it is safe to map
+			if d.mmapReads {
+				mapping, err = mmapFile(f, int(end))
+				if err != nil {
+					d.logf(WARN, "DISKQUEUE(%s) failed to mmap %s, falling back to buffered reads - %s",
+						d.name, fileName, err)
+					mapping = nil
+				}
+			}
+		}
+	}
+
+	return f, mapping, end, nil
+}
+
+// dataEnd returns where the messages of the complete file f end
+func (d *diskQueue) dataEnd(f File) (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	end := stat.Size()
+	if d.enableDiskLimitation {
+		// last 8 bytes are reserved for the number of messages in this file
+		end -= numFileMsgBytes
+	}
+	return end, nil
+}
+
+// newFileReader returns a reader over f, which is positioned at pos,
+// or over its mapping if there is one
+//
+// limit returns where the written data ends while f is preallocated and
+// written to, it is nil otherwise
+func newFileReader(f File, mapping []byte, pos int64, limit func() int64) io.Reader {
+	if mapping != nil {
+		// messages are copied out of the mapping exactly once by readFrame
+		mmapReader := bytes.NewReader(mapping)
+		mmapReader.Seek(pos, io.SeekStart)
+		return mmapReader
+	}
+	if limit != nil {
+		return bufio.NewReader(&writtenReader{f: f, pos: pos, limit: limit})
+	}
+	return bufio.NewReader(f)
+}
+
+// closeReadFile closes readFile along with its mapping, if any
+func (d *diskQueue) closeReadFile() {
+	d.closeMappedFile(d.readFile, d.readMmap)
+	d.readMmap = nil
+	d.readFile = nil
+}
+
+func (d *diskQueue) closeMappedFile(f File, mapping []byte) {
+	if mapping != nil {
+		err := munmapFile(mapping)
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to munmap %s - %s", d.name, f.Name(), err)
+		}
+	}
+
+	f.Close()
+}
+
+// frame is a single message as it is stored on disk
+//
+// a non-negative length prefix is followed directly by the message, while a
+// negative length prefix marks an extended frame: its absolute value is the
+// size of the rest of the frame which begins with a flags byte describing the
+// optional fields that precede the message
+type frame struct {
+	data      []byte
+	timestamp int64 // unix nanoseconds at write time, 0 when not recorded
+	expiry    int64 // unix nanoseconds after which it is dropped, 0 for never
+	deliverAt int64 // unix nanoseconds before which it is held back, 0 for now
+	promoted  bool  // a delayed frame that was already moved to the queue
+	headers   map[string][]byte
+
+	// given to PutIdempotent(), it is not stored
+	dedupKey string
+
+	buf *[]byte // pooled buffer backing data, if any
+}
+
+const (
+	frameFlagTimestamp = 1 << iota
+	frameFlagExpiry
+	frameFlagDeliverAt
+	frameFlagPromoted // has no field
+	frameFlagHeaders
+)
+
+// frameHeaderSize returns the size of the optional fields for the given flags
+func frameHeaderSize(flags byte) int32 {
+	size := int32(1)
+	if flags&frameFlagTimestamp != 0 {
+		size += 8
+	}
+	if flags&frameFlagExpiry != 0 {
+		size += 8
+	}
+	if flags&frameFlagDeliverAt != 0 {
+		size += 8
+	}
+	if flags&frameFlagHeaders != 0 {
+		// size of the encoded headers, which are not included
+		size += 4
+	}
+	return size
+}
+
+// frameFlags returns the flags needed to store f, stamping it with the
+// current time if required
+func (d *diskQueue) frameFlags(f *frame) byte {
+	var flags byte
+	if d.enableRetention || d.maxMsgAge > 0 {
+		// timestamps let RewindTo() find where to resume from
+		// and let messages expire once they are older than maxMsgAge
+		flags |= frameFlagTimestamp
+		if f.timestamp == 0 {
+			// a promoted delayed message keeps the time it was put at
+			f.timestamp = time.Now().UnixNano()
+		}
+	}
+	if f.expiry != 0 {
+		flags |= frameFlagExpiry
+	}
+	if f.deliverAt != 0 {
+		flags |= frameFlagDeliverAt
+	}
+	if len(f.headers) > 0 {
+		flags |= frameFlagHeaders
+	}
+	return flags
+}
+
+// deadline returns the unix nanoseconds after which f is dropped rather than
+// read, 0 if it never expires
+func (d *diskQueue) deadline(f frame) int64 {
+	deadline := f.expiry
+	if d.maxMsgAge > 0 && f.timestamp != 0 {
+		maxAgeDeadline := f.timestamp + int64(d.maxMsgAge)
+		if deadline == 0 || maxAgeDeadline < deadline {
+			deadline = maxAgeDeadline
+		}
+	}
+	return deadline
+}
+
+// readFrame decodes the next frame from r and returns it along with the
+// number of bytes it occupies on disk
+func (d *diskQueue) readFrame(r io.Reader) (frame, int64, error) {
+	var f frame
+	// a single scratch buffer for the header fields, binary.Read allocates
+	// one for each of them
+	scratch := make([]byte, 8)
+
+	_, err := io.ReadFull(r, scratch[:4])
+	if err != nil {
+		return f, 0, err
+	}
+	msgSize := int32(binary.BigEndian.Uint32(scratch))
+
+	totalBytes := int64(4)
+	if msgSize < 0 {
+		frameSize := -int64(msgSize)
+		_, err = io.ReadFull(r, scratch[:1])
+		if err != nil {
+			return f, 0, err
+		}
+		flags := scratch[0]
+		headerSize := int64(frameHeaderSize(flags))
+		maxSize := int64(d.maxMsgSize)
+		if flags&frameFlagHeaders != 0 {
+			// headers are limited to maxMsgSize on top of the message
+			maxSize *= 2
+		}
+		if frameSize < headerSize || frameSize-headerSize > maxSize {
+			// this file is corrupt and we have no reasonable guarantee on
+			// where a new message should begin
+			return f, 0, fmt.Errorf("invalid frame read size (%d)", frameSize)
+		}
+		if flags&frameFlagTimestamp != 0 {
+			f.timestamp, err = readInt64(r, scratch)
+			if err != nil {
+				return f, 0, err
+			}
+		}
+		if flags&frameFlagExpiry != 0 {
+			f.expiry, err = readInt64(r, scratch)
+			if err != nil {
+				return f, 0, err
+			}
+		}
+		if flags&frameFlagDeliverAt != 0 {
+			f.deliverAt, err = readInt64(r, scratch)
+			if err != nil {
+				return f, 0, err
+			}
+		}
+		if flags&frameFlagHeaders != 0 {
+			_, err = io.ReadFull(r, scratch[:4])
+			if err != nil {
+				return f, 0, err
+			}
+			headersSize := int64(int32(binary.BigEndian.Uint32(scratch)))
+			if headersSize < 0 || headersSize > frameSize-headerSize || headersSize > int64(d.maxMsgSize) {
+				return f, 0, fmt.Errorf("invalid headers read size (%d)", headersSize)
+			}
+			encoded := make([]byte, headersSize)
+			_, err = io.ReadFull(r, encoded)
+			if err != nil {
+				return f, 0, err
+			}
+			f.headers, err = decodeHeaders(encoded)
+			if err != nil {
+				return f, 0, err
+			}
+			headerSize += headersSize
+		}
+		f.promoted = flags&frameFlagPromoted != 0
+		totalBytes += headerSize
+		msgSize = int32(frameSize - headerSize)
+	}
+
+	if msgSize < d.minMsgSize || msgSize > d.maxMsgSize {
+		// this file is corrupt and we have no reasonable guarantee on
+		// where a new message should begin
+		return f, 0, fmt.Errorf("invalid message read size (%d)", msgSize)
+	}
+
+	if d.bufPool != nil {
+		f.buf = d.bufPool.get(int(msgSize))
+		f.data = (*f.buf)[:msgSize:msgSize]
+	} else {
+		f.data = make([]byte, msgSize)
+	}
+	_, err = io.ReadFull(r, f.data)
+	if err != nil {
+		d.releaseFrame(f)
+		return frame{}, 0, err
+	}
+
+	return f, totalBytes + int64(msgSize), nil
+}
+
+func readInt64(r io.Reader, scratch []byte) (int64, error) {
+	_, err := io.ReadFull(r, scratch[:8])
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(scratch)), nil
 }
 
 func (d *diskQueue) removeBadFile(oldestBadFileInfo os.FileInfo) error {
@@ -450,7 +1098,10 @@ func (d *diskQueue) removeBadFile(oldestBadFileInfo os.FileInfo) error {
 	badFileFilePath := path.Join(d.dataPath, oldestBadFileInfo.Name())
 
 	// remove file if it exists
-	err = os.Remove(badFileFilePath)
+	err = d.fs.Remove(badFileFilePath)
+	if err == nil {
+		d.replicateRemove(badFileFilePath)
+	}
 	if err != nil {
 		d.logf(ERROR, "DISKQUEUE(%s) failed to remove .bad file(%s) - %s", d.name, oldestBadFileInfo.Name(), err)
 		d.updateTotalDiskSpaceUsed()
@@ -468,17 +1119,13 @@ func (d *diskQueue) readNumOfMessages(fileName string) (int64, error) {
 	var err error
 
 	if d.readFile == nil {
-		d.readFile, err = os.OpenFile(fileName, os.O_RDONLY, 0600)
+		d.readFile, err = d.fs.OpenFile(fileName, os.O_RDONLY, 0600)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	closeReadFile := func() {
-		d.readFile.Close()
-		d.readFile = nil
-	}
-	defer closeReadFile()
+	defer d.closeReadFile()
 
 	// read total messages number at the end of the file
 	_, err = d.readFile.Seek(-numFileMsgBytes, 2)
@@ -516,14 +1163,105 @@ func (d *diskQueue) removeReadFile() error {
 		d.nextReadPos = 0
 	}
 
+	evictedFileNum := d.readFileNum
 	d.moveToNextReadFile()
 
+	if d.enableRetention {
+		// the evicted file was never consumed so it is not retained
+		d.removeDataFile(evictedFileNum)
+		if d.retainedFileNum == evictedFileNum {
+			d.retainedFileNum = d.readFileNum
+		}
+	}
+
+	return nil
+}
+
+// rewindTo scans the retained files and the consumed part of the current read
+// file for the first message written at or after t and resets the read
+// position to it
+//
+// messages written without a timestamp (i.e. before retention was enabled)
+// are considered older than any t
+func (d *diskQueue) rewindTo(t time.Time) error {
+	target := t.UnixNano()
+	found := false
+
+	var rewindFileNum, rewindPos, rewindMessages, replayed int64
+
+	for i := d.retainedFileNum; i <= d.readFileNum; i++ {
+		f, err := d.fs.OpenFile(d.fileName(i), os.O_RDONLY, 0600)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		// only the consumed part of the current read file needs to be scanned
+		endPos := d.readPos
+		if i < d.readFileNum {
+			endPos, err = d.dataEnd(f)
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+
+		reader := bufio.NewReader(f)
+		var pos, messages int64
+		for pos < endPos {
+			fr, totalBytes, err := d.readFrame(reader)
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("failed to scan %s at %d - %s", d.fileName(i), pos, err)
+			}
+
+			if !found && fr.timestamp >= target {
+				found = true
+				rewindFileNum = i
+				rewindPos = pos
+				rewindMessages = messages
+			}
+			if found {
+				replayed++
+			}
+
+			d.releaseFrame(fr)
+			pos += totalBytes
+			messages++
+		}
+		f.Close()
+	}
+
+	if !found {
+		// nothing retained was written at or after t
+		return nil
+	}
+
+	if d.readFile != nil {
+		d.closeReadFile()
+	}
+
+	d.readFileNum = rewindFileNum
+	d.readPos = rewindPos
+	d.nextReadFileNum = rewindFileNum
+	d.nextReadPos = rewindPos
+	d.depth += replayed
+	if d.enableDiskLimitation {
+		d.readMessages = rewindMessages
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s) rewound to %d of %s, %d messages pending again",
+		d.name, rewindPos, d.fileName(rewindFileNum), replayed)
+
+	d.needSync = true
 	return nil
 }
 
 // walk through all of the files in the DiskQueue directory
 func (d *diskQueue) walkDiskQueueDir(fn func(os.FileInfo) error) error {
-	fileInfos, err := ioutil.ReadDir(d.dataPath)
+	fileInfos, err := d.fs.ReadDir(d.dataPath)
 
 	if err != nil {
 		return err
@@ -547,7 +1285,7 @@ func (d *diskQueue) getAllBadFileInfo() ([]os.FileInfo, error) {
 
 	getAllBadFileInfo := func(fileInfo os.FileInfo) error {
 		// only accept "bad" files created by this DiskQueue object
-		if badFileNameRegexp.MatchString(fileInfo.Name()) {
+		if d.badFileNameRegexp.MatchString(fileInfo.Name()) {
 			badFileInfos = append(badFileInfos, fileInfo)
 		}
 
@@ -565,7 +1303,10 @@ func (d *diskQueue) updateTotalDiskSpaceUsed() {
 
 	updateTotalDiskSpaceUsed := func(fileInfo os.FileInfo) error {
 		// only accept files created by this DiskQueue object
-		if fileNameRegexp.MatchString(fileInfo.Name()) || badFileNameRegexp.MatchString(fileInfo.Name()) {
+		// a preallocated file is accounted for with its tail, as it is
+		// allocated on disk
+		if d.fileNameRegexp.MatchString(fileInfo.Name()) || d.badFileNameRegexp.MatchString(fileInfo.Name()) ||
+			fileInfo.Name() == path.Base(d.delayedFileName()) || fileInfo.Name() == path.Base(d.dedupFileName()) {
 			d.totalDiskSpaceUsed += fileInfo.Size()
 		}
 
@@ -576,6 +1317,7 @@ func (d *diskQueue) updateTotalDiskSpaceUsed() {
 	if err != nil {
 		d.logf(ERROR, "DISKQUEUE(%s) failed to update write bytes - %s", d.name, err)
 	}
+	d.totalDiskSpaceUsed += d.txStaged
 }
 
 func (d *diskQueue) freeDiskSpace(expectedBytesIncrease int64) error {
@@ -594,7 +1336,20 @@ func (d *diskQueue) freeDiskSpace(expectedBytesIncrease int64) error {
 		}
 		d.removeBadFile(badFileInfo)
 	}
-	for d.readFileNum <= d.writeFileNum {
+	// consumed data goes before any data that has not been read yet
+	for d.enableRetention && d.retainedFileNum < d.readFileNum {
+		if d.totalDiskSpaceUsed+expectedBytesIncrease <= d.maxBytesDiskSpace {
+			return nil
+		}
+		err = d.removeDataFile(d.retainedFileNum)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.retainedFileNum++
+		d.updateTotalDiskSpaceUsed()
+	}
+	// unread data is only dropped by FullEvictOldest
+	for d.fullPolicy == FullEvictOldest && d.readFileNum <= d.writeFileNum {
 		if d.totalDiskSpaceUsed+expectedBytesIncrease <= d.maxBytesDiskSpace {
 			return nil
 		}
@@ -612,12 +1367,53 @@ func (d *diskQueue) freeDiskSpace(expectedBytesIncrease int64) error {
 	}
 
 	if d.totalDiskSpaceUsed+expectedBytesIncrease > d.maxBytesDiskSpace {
-		return fmt.Errorf("could not make space for totalDiskSpaceUsed = %d, expectedBytesIncrease = %d, with maxBytesDiskSpace = %d ", d.totalDiskSpaceUsed, expectedBytesIncrease, d.maxBytesDiskSpace)
+		return fmt.Errorf("%w: could not make space for totalDiskSpaceUsed = %d, expectedBytesIncrease = %d, with maxBytesDiskSpace = %d ", ErrDiskFull, d.totalDiskSpaceUsed, expectedBytesIncrease, d.maxBytesDiskSpace)
 	}
 
 	return nil
 }
 
+// evictOldestFile frees disk space by removing the oldest .bad, retained
+// or unread file, in that order
+//
+// it is used by queues that share one disk space budget between several
+// diskQueues, which all need to have the disk limit feature enabled
+func (d *diskQueue) evictOldestFile() error {
+	badFileInfos, err := d.getAllBadFileInfo()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to retrieve all .bad file info - %s", d.name, err)
+	}
+	if len(badFileInfos) > 0 {
+		return d.removeBadFile(badFileInfos[0])
+	}
+
+	if d.enableRetention && d.retainedFileNum < d.readFileNum {
+		err = d.removeDataFile(d.retainedFileNum)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.retainedFileNum++
+		d.updateTotalDiskSpaceUsed()
+		return nil
+	}
+
+	if d.readFileNum == d.writeFileNum && d.readPos == d.writePos {
+		return errors.New("no file to evict")
+	}
+
+	readFileToDeleteNum := d.readFileNum
+	err = d.removeReadFile()
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to remove file(%s) - %s", d.name, d.fileName(readFileToDeleteNum), err)
+		d.handleReadError()
+	} else {
+		d.logf(INFO, "DISKQUEUE(%s) removed file(%s) to free up disk space", d.name, d.fileName(readFileToDeleteNum))
+	}
+	d.updateTotalDiskSpaceUsed()
+
+	return err
+}
+
 // check if there is enough available disk space to write new data to file
 func (d *diskQueue) checkDiskSpace(expectedBytesIncrease int64) error {
 	// If the data to be written is bigger than the disk size limit, do not write
@@ -626,7 +1422,7 @@ func (d *diskQueue) checkDiskSpace(expectedBytesIncrease int64) error {
 			"message size(%d) surpasses disk size limit(%d)",
 			expectedBytesIncrease, d.maxBytesDiskSpace)
 		d.logf(ERROR, "DISKQUEUE(%s) - %s", d.name, errorMsg)
-		return errors.New(errorMsg)
+		return fmt.Errorf("%w: %s", ErrMsgSize, errorMsg)
 	}
 
 	// check if we have enough space to write this message
@@ -636,20 +1432,42 @@ func (d *diskQueue) checkDiskSpace(expectedBytesIncrease int64) error {
 	return nil
 }
 
-// writeOne performs a low level filesystem write for a single []byte
+// write handles a frame received from writeChan
+func (d *diskQueue) write(f frame) error {
+	if f.dedupKey != "" {
+		return d.writeIdempotent(f)
+	}
+
+	err := d.checkDepth(1)
+	if err != nil {
+		return err
+	}
+
+	if f.deliverAt > time.Now().UnixNano() {
+		return d.writeDelayed(f)
+	}
+	f.deliverAt = 0
+	return d.writeOne(f)
+}
+
+// writeOne performs a low level filesystem write for a single frame
 // while advancing write positions and rolling files, if necessary
-func (d *diskQueue) writeOne(data []byte) error {
+func (d *diskQueue) writeOne(f frame) error {
 	var err error
 
 	if d.writeFile == nil {
 		curFileName := d.fileName(d.writeFileNum)
-		d.writeFile, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
+		d.writeFile, err = d.fs.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
 		if err != nil {
 			return err
 		}
 
 		d.logf(INFO, "DISKQUEUE(%s): writeOne() opened %s", d.name, curFileName)
 
+		if d.preallocateFiles {
+			d.preallocate(d.writeFile)
+		}
+
 		if d.writePos > 0 {
 			_, err = d.writeFile.Seek(d.writePos, 0)
 			if err != nil {
@@ -660,13 +1478,19 @@ func (d *diskQueue) writeOne(data []byte) error {
 		}
 	}
 
-	dataLen := int32(len(data))
+	dataLen := int32(len(f.data))
 
 	if dataLen < d.minMsgSize || dataLen > d.maxMsgSize {
-		return fmt.Errorf("invalid message write size (%d) minMsgSize=%d maxMsgSize=%d", dataLen, d.minMsgSize, d.maxMsgSize)
+		return fmt.Errorf("%w (%d) minMsgSize=%d maxMsgSize=%d", ErrMsgSize, dataLen, d.minMsgSize, d.maxMsgSize)
 	}
 
+	flags := d.frameFlags(&f)
+	headers := encodeHeaders(f.headers)
+	extended := flags != 0
 	totalBytes := int64(4 + dataLen)
+	if extended {
+		totalBytes += int64(frameHeaderSize(flags)) + int64(len(headers))
+	}
 	reachedFileSizeLimit := false
 
 	if d.enableDiskLimitation {
@@ -677,10 +1501,20 @@ func (d *diskQueue) writeOne(data []byte) error {
 			expectedBytesIncrease += numFileMsgBytes
 		}
 
-		// free disk space if needed
-		err = d.checkDiskSpace(expectedBytesIncrease)
-		if err != nil {
-			return err
+		// the preallocated part of the file is already accounted for
+		if d.writeFileReserved >= expectedBytesIncrease {
+			expectedBytesIncrease = 0
+		} else {
+			expectedBytesIncrease -= d.writeFileReserved
+		}
+
+		// free disk space if needed, a transaction did so for all of its
+		// messages
+		if !d.applyingTx {
+			err = d.checkDiskSpace(expectedBytesIncrease)
+			if err != nil {
+				return err
+			}
 		}
 	} else if d.writePos+totalBytes >= d.maxBytesPerFile {
 		reachedFileSizeLimit = true
@@ -689,20 +1523,24 @@ func (d *diskQueue) writeOne(data []byte) error {
 	// add all data to writeBuf before writing to file
 	// this causes everything to be written to file or nothing
 	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
-	if err != nil {
-		return err
+	if !extended {
+		writeInt32(&d.writeBuf, dataLen)
+	} else {
+		d.writeFrameHeader(flags, f, headers)
 	}
 
-	_, err = d.writeBuf.Write(data)
-	if err != nil {
-		return err
-	}
+	d.writeBuf.Write(f.data)
 
 	// check if we reached the file size limit with this message
 	if d.enableDiskLimitation && reachedFileSizeLimit {
 		// write number of messages in binary to file
-		err = binary.Write(&d.writeBuf, binary.BigEndian, d.writeMessages+1)
+		writeInt64(&d.writeBuf, d.writeMessages+1)
+	}
+
+	if reachedFileSizeLimit && d.writeFileReserved > 0 {
+		// the preallocated tail is dropped before the file is completed, so
+		// that a complete file never has one, even after a crash
+		err = d.writeFile.Truncate(d.writePos + int64(d.writeBuf.Len()))
 		if err != nil {
 			return err
 		}
@@ -711,17 +1549,35 @@ func (d *diskQueue) writeOne(data []byte) error {
 	// only write to the file once
 	_, err = d.writeFile.Write(d.writeBuf.Bytes())
 	if err != nil {
+		// drop whatever part of the message was written (e.g. on ENOSPC),
+		// or it would be read back once the file is complete
+		truncErr := d.writeFile.Truncate(d.writePos)
+		if truncErr != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to truncate %s - %s", d.name, d.writeFile.Name(), truncErr)
+		}
+		d.releaseReserved()
 		d.writeFile.Close()
 		d.writeFile = nil
 		return err
 	}
+	d.replicateWrite(d.writeFile.Name(), d.writePos, d.writeBuf.Bytes())
+
+	// the file only grows past what was preallocated
+	grown := totalBytes - d.writeFileReserved
+	if grown < 0 {
+		grown = 0
+	}
+	d.writeFileReserved -= totalBytes - grown
 
 	d.writePos += totalBytes
 	d.depth += 1
 
 	if d.enableDiskLimitation {
-		d.totalDiskSpaceUsed += totalBytes
+		d.totalDiskSpaceUsed += grown
 		d.writeMessages += 1
+		// before the writer is told, so that the budget it shares accounts
+		// for the message
+		d.publishUsage()
 	}
 
 	if reachedFileSizeLimit {
@@ -729,6 +1585,9 @@ func (d *diskQueue) writeOne(data []byte) error {
 			d.maxBytesPerFileRead = d.writePos
 		}
 
+		// what was left of the reservation was truncated above
+		d.releaseReserved()
+
 		d.writeFileNum++
 		d.writePos = 0
 
@@ -751,6 +1610,45 @@ func (d *diskQueue) writeOne(data []byte) error {
 	return err
 }
 
+// writeFrameHeader adds the length prefix and optional fields of an
+// extended frame to writeBuf, headers being f.headers as encoded by
+// encodeHeaders
+func (d *diskQueue) writeFrameHeader(flags byte, f frame, headers []byte) {
+	writeInt32(&d.writeBuf, -(frameHeaderSize(flags) + int32(len(headers)) + int32(len(f.data))))
+	d.writeBuf.WriteByte(flags)
+
+	if flags&frameFlagTimestamp != 0 {
+		writeInt64(&d.writeBuf, f.timestamp)
+	}
+
+	if flags&frameFlagExpiry != 0 {
+		writeInt64(&d.writeBuf, f.expiry)
+	}
+
+	if flags&frameFlagDeliverAt != 0 {
+		writeInt64(&d.writeBuf, f.deliverAt)
+	}
+
+	if flags&frameFlagHeaders != 0 {
+		writeInt32(&d.writeBuf, int32(len(headers)))
+		d.writeBuf.Write(headers)
+	}
+}
+
+// writeInt32 and writeInt64 append big endian integers to buf without the
+// allocation binary.Write makes for each of them
+func writeInt32(buf *bytes.Buffer, v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	buf.Write(b[:])
+}
+
+func writeInt64(buf *bytes.Buffer, v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	buf.Write(b[:])
+}
+
 // sync fsyncs the current writeFile and persists metadata
 func (d *diskQueue) sync() error {
 	if d.writeFile != nil {
@@ -762,6 +1660,24 @@ func (d *diskQueue) sync() error {
 		}
 	}
 
+	if d.delayedFile != nil {
+		err := d.delayedFile.Sync()
+		if err != nil {
+			d.delayedFile.Close()
+			d.delayedFile = nil
+			return err
+		}
+	}
+
+	if d.dedupFile != nil {
+		err := d.dedupFile.Sync()
+		if err != nil {
+			d.dedupFile.Close()
+			d.dedupFile = nil
+			return err
+		}
+	}
+
 	if d.enableDiskLimitation {
 		d.updateTotalDiskSpaceUsed()
 	}
@@ -777,11 +1693,11 @@ func (d *diskQueue) sync() error {
 
 // retrieveMetaData initializes state from the filesystem
 func (d *diskQueue) retrieveMetaData() error {
-	var f *os.File
+	var f File
 	var err error
 
 	fileName := d.metaDataFileName()
-	f, err = os.OpenFile(fileName, os.O_RDONLY, 0600)
+	f, err = d.fs.OpenFile(fileName, os.O_RDONLY, 0600)
 	if err != nil {
 		return err
 	}
@@ -814,39 +1730,49 @@ func (d *diskQueue) retrieveMetaData() error {
 
 // persistMetaData atomically writes state to the filesystem
 func (d *diskQueue) persistMetaData() error {
-	var f *os.File
+	var f File
 	var err error
 
 	fileName := d.metaDataFileName()
 	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
 
 	// write to tmp file
-	f, err = os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	f, err = d.fs.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return err
 	}
 
 	// if user is using disk space limit feature
+	var buf bytes.Buffer
 	if d.enableDiskLimitation {
-		_, err = fmt.Fprintf(f, "%d\n%d,%d,%d\n%d,%d,%d\n",
+		fmt.Fprintf(&buf, "%d\n%d,%d,%d\n%d,%d,%d\n",
 			d.depth,
 			d.readFileNum, d.readMessages, d.readPos,
 			d.writeFileNum, d.writeMessages, d.writePos)
 	} else {
-		_, err = fmt.Fprintf(f, "%d\n%d,%d\n%d,%d\n",
+		fmt.Fprintf(&buf, "%d\n%d,%d\n%d,%d\n",
 			d.depth,
 			d.readFileNum, d.readPos,
 			d.writeFileNum, d.writePos)
 	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
 	if err != nil {
-		f.Close()
+		d.fs.Remove(tmpFileName)
 		return err
 	}
-	f.Sync()
-	f.Close()
 
 	// atomically rename
-	return os.Rename(tmpFileName, fileName)
+	err = d.fs.Rename(tmpFileName, fileName)
+	if err != nil {
+		d.fs.Remove(tmpFileName)
+		return err
+	}
+	d.replicateFile(fileName, buf.Bytes())
+	return nil
 }
 
 func (d *diskQueue) metaDataFileName() string {
@@ -908,22 +1834,114 @@ func (d *diskQueue) moveToNextReadFile() {
 		// sync every time we start reading from a new file
 		d.needSync = true
 
-		fn := d.fileName(oldReadFileNum)
-		oldFileInfo, _ := os.Stat(fn)
-
-		err := os.Remove(fn)
-		if err != nil {
-			d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+		if d.enableRetention {
+			// keep the consumed file so that it can be replayed with RewindTo()
+			d.pruneRetainedFiles()
 		} else {
-			d.logf(INFO, "DISKQUEUE(%s) removed(%s) of size(%d bytes)", d.name, fn, oldFileInfo.Size())
+			d.removeDataFile(oldReadFileNum)
 		}
 
 		if d.enableDiskLimitation {
 			d.readMessages = 0
-			if err != nil {
-				d.logf(ERROR, "DISKQUEUE(%s) failed to update write bytes - %s", d.name, err)
+		}
+	}
+}
+
+func (d *diskQueue) removeDataFile(fileNum int64) error {
+	fn := d.fileName(fileNum)
+	oldFileInfo, _ := d.fs.Stat(fn)
+
+	err := d.fs.Remove(fn)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to Remove(%s) - %s", d.name, fn, err)
+	} else {
+		d.replicateRemove(fn)
+		d.logf(INFO, "DISKQUEUE(%s) removed(%s) of size(%d bytes)", d.name, fn, oldFileInfo.Size())
+	}
+
+	return err
+}
+
+// pruneRetainedFiles removes the oldest consumed files until the remaining
+// ones satisfy both the retention period and the retention size
+func (d *diskQueue) pruneRetainedFiles() {
+	var retainedBytes int64
+	var fileInfos []os.FileInfo
+
+	for i := d.retainedFileNum; i < d.readFileNum; i++ {
+		fileInfo, err := d.fs.Stat(d.fileName(i))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to stat retained file(%s) - %s", d.name, d.fileName(i), err)
+			}
+			fileInfo = nil
+		} else {
+			retainedBytes += fileInfo.Size()
+		}
+		fileInfos = append(fileInfos, fileInfo)
+	}
+
+	now := time.Now()
+	for _, fileInfo := range fileInfos {
+		if fileInfo != nil {
+			expired := d.retentionPeriod > 0 && now.Sub(fileInfo.ModTime()) > d.retentionPeriod
+			oversized := d.retentionBytes > 0 && retainedBytes > d.retentionBytes
+			if !expired && !oversized {
+				return
+			}
+
+			err := d.removeDataFile(d.retainedFileNum)
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+			retainedBytes -= fileInfo.Size()
+			if d.enableDiskLimitation {
+				d.totalDiskSpaceUsed -= fileInfo.Size()
 			}
 		}
+		d.retainedFileNum++
+	}
+}
+
+// removeRetainedFiles removes every consumed file that is still kept on disk
+func (d *diskQueue) removeRetainedFiles() error {
+	var err error
+
+	for ; d.retainedFileNum < d.readFileNum; d.retainedFileNum++ {
+		innerErr := d.fs.Remove(d.fileName(d.retainedFileNum))
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to remove retained file - %s", d.name, innerErr)
+			err = innerErr
+		} else {
+			d.replicateRemove(d.fileName(d.retainedFileNum))
+		}
+	}
+
+	return err
+}
+
+// findRetainedFiles locates the oldest consumed file left on disk
+// by a previous instance
+func (d *diskQueue) findRetainedFiles() {
+	d.retainedFileNum = d.readFileNum
+
+	findRetainedFiles := func(fileInfo os.FileInfo) error {
+		if !d.fileNameRegexp.MatchString(fileInfo.Name()) {
+			return nil
+		}
+
+		var fileNum int64
+		_, err := fmt.Sscanf(fileInfo.Name(), d.name+".diskqueue.%d.dat", &fileNum)
+		if err == nil && fileNum < d.retainedFileNum {
+			d.retainedFileNum = fileNum
+		}
+
+		return nil
+	}
+
+	err := d.walkDiskQueueDir(findRetainedFiles)
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to find retained files - %s", d.name, err)
 	}
 }
 
@@ -950,6 +1968,7 @@ func (d *diskQueue) handleReadError() {
 		}
 		d.writeFileNum++
 		d.writePos = 0
+		d.writeFileReserved = 0
 
 		if d.enableDiskLimitation {
 			d.writeMessages = 0
@@ -963,11 +1982,13 @@ func (d *diskQueue) handleReadError() {
 		"DISKQUEUE(%s) jump to next file and saving bad file as %s",
 		d.name, badRenameFn)
 
-	err := os.Rename(badFn, badRenameFn)
+	err := d.fs.Rename(badFn, badRenameFn)
 	if err != nil {
 		d.logf(ERROR,
 			"DISKQUEUE(%s) failed to rename bad diskqueue file %s to %s",
 			d.name, badFn, badRenameFn)
+	} else {
+		d.replicateRename(badFn, badRenameFn)
 	}
 
 	d.readFileNum++
@@ -993,15 +2014,51 @@ func (d *diskQueue) handleReadError() {
 //
 // conveniently this also means that we're asynchronously reading from the filesystem
 func (d *diskQueue) ioLoop() {
-	var dataRead []byte
+	var dataRead frame
 	var err error
 	var count int64
 	var r chan []byte
 	var p chan []byte
+	var m chan Message
+	var e <-chan time.Time
+	var deadline int64
+	var dl <-chan time.Time
+	var delayedAt int64
+	var ra chan readResult
+	var s chan Position
+	var t chan Position
+	var h chan head
+	var msg Message
+	var shared bool // dataRead was handed out to peekers
+	var pending, used int64
+	// disk space used when due delayed messages last found the disk full
+	promoteUsed := int64(-1)
 
 	syncTicker := time.NewTicker(d.syncTimeout)
+	expireTimer := time.NewTimer(0)
+	<-expireTimer.C
+	delayTimer := time.NewTimer(0)
+	<-delayTimer.C
+
+	// wake up when the message read expires while waiting for readers
+	armExpireTimer := func() {
+		e = nil
+		deadline = d.deadline(dataRead)
+		if deadline != 0 {
+			if !expireTimer.Stop() {
+				select {
+				case <-expireTimer.C:
+				default:
+				}
+			}
+			expireTimer.Reset(time.Duration(deadline - time.Now().UnixNano()))
+			e = expireTimer.C
+		}
+	}
 
 	for {
+		d.publishUsage()
+
 		// dont sync all the time :)
 		if count == d.syncEvery {
 			d.needSync = true
@@ -1015,39 +2072,177 @@ func (d *diskQueue) ioLoop() {
 			count = 0
 		}
 
+		// once the disk is full, due messages stay pending until space is freed
+		if len(d.delayed) > 0 && (promoteUsed < 0 || d.totalDiskSpaceUsed < promoteUsed) {
+			promoteUsed = -1
+			err = d.promoteDelayed(time.Now().UnixNano())
+			if errors.Is(err, ErrDiskFull) {
+				promoteUsed = d.totalDiskSpaceUsed
+				d.logf(WARN, "DISKQUEUE(%s) holding back due delayed messages until disk space is freed", d.name)
+			} else if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) failed to promote delayed messages - %s", d.name, err)
+			}
+		}
+
+		// wake up when the next delayed message is due
+		if len(d.delayed) == 0 {
+			dl = nil
+			delayedAt = 0
+		} else if d.delayed[0].deliverAt != delayedAt {
+			delayedAt = d.delayed[0].deliverAt
+			if !delayTimer.Stop() {
+				select {
+				case <-delayTimer.C:
+				default:
+				}
+			}
+			delayTimer.Reset(time.Duration(delayedAt - time.Now().UnixNano()))
+			dl = delayTimer.C
+		}
+
+		if d.fullPolicy == FullBlock {
+			if d.pending() < pending || d.totalDiskSpaceUsed < used {
+				d.wakeBlocked()
+			}
+			pending = d.pending()
+			used = d.totalDiskSpaceUsed
+		}
+
+		if len(d.watermarks) > 0 {
+			d.updateWatermarks()
+		}
+
+		if d.readAheadSize > 0 {
+			d.syncReadAhead()
+		}
+
+		ra = nil
+		s = d.skipChan
+		t = d.takeChan
 		if (d.readFileNum < d.writeFileNum) || (d.readPos < d.writePos) {
-			if d.nextReadPos == d.readPos {
-				dataRead, err = d.readOne()
-				if err != nil {
-					d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
-						d.name, d.readPos, d.fileName(d.readFileNum), err)
-					d.handleReadError()
+			if d.nextReadPos == d.readPos && d.nextReadFileNum == d.readFileNum {
+				if d.readAhead != nil {
+					// wait for the read-ahead goroutine to decode it
+					ra = d.readAhead.resultChan
+				} else {
+					dataRead, err = d.readOne()
+					shared = false
+					if err != nil {
+						d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+							d.name, d.readPos, d.fileName(d.readFileNum), err)
+						d.handleReadError()
+						continue
+					}
+					armExpireTimer()
+				}
+			}
+			if ra != nil {
+				// nothing to hand out until it is received
+				s = nil
+				t = nil
+				r = nil
+				p = nil
+				h = nil
+				m = nil
+				e = nil
+				deadline = 0
+			} else {
+				if deadline != 0 && time.Now().UnixNano() > deadline {
+					// consume it without handing it to readers
+					count++
+					if d.onExpire != nil {
+						d.onExpire(dataRead.data)
+					}
+					d.moveForward()
+					deadline = 0
 					continue
 				}
+				r = d.readChan
+				p = d.peekChan
+				h = d.headChan
+				m = d.messageChan
 			}
-			r = d.readChan
-			p = d.peekChan
 		} else {
 			r = nil
 			p = nil
+			h = nil
+			m = nil
+			e = nil
+			deadline = 0
+		}
+
+		msg = Message{Headers: dataRead.headers, Body: dataRead.data, buf: dataRead.buf, pool: d.bufPool}
+		if shared {
+			// a peeker may still be using it, so it is not recycled
+			msg.buf = nil
 		}
 
 		select {
 		// the Go channel spec dictates that nil channel operations (read or write)
 		// in a select are skipped, we set r to d.readChan only when there is data to read
-		case p <- dataRead:
-		case r <- dataRead:
+		case p <- dataRead.data:
+			shared = true
+		case h <- head{pos: Position{FileNum: d.readFileNum, Offset: d.readPos}, data: dataRead.data}:
+			shared = true
+		case r <- dataRead.data:
 			count++
 			// moveForward sets needSync flag if a file is removed
 			d.moveForward()
-		case d.depthChan <- d.depth:
+		case m <- msg:
+			count++
+			d.moveForward()
+		case res := <-ra:
+			if res.err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+					d.name, d.readPos, d.fileName(d.readFileNum), res.err)
+				d.stopReadAhead()
+				d.handleReadError()
+				continue
+			}
+			d.readAhead.received(res)
+			dataRead = res.frame
+			shared = false
+			d.nextReadFileNum = res.nextFileNum
+			d.nextReadPos = res.nextPos
+			armExpireTimer()
+		case d.depthChan <- d.depth + int64(len(d.delayed)):
 		case <-d.emptyChan:
 			d.emptyResponseChan <- d.deleteAllFiles()
 			count = 0
+		case t := <-d.rewindChan:
+			d.rewindResponseChan <- d.rewindTo(t)
+		case d.usageChan <- d.totalDiskSpaceUsed:
+		case <-d.evictChan:
+			err = d.evictOldestFile()
+			d.publishUsage()
+			d.evictResponseChan <- err
+		case conn := <-d.followChan:
+			d.followResponseChan <- d.addFollower(conn)
+		case <-d.scanChan:
+			d.scanResponseChan <- d.openScan()
+		case tx := <-d.commitChan:
+			d.commitResponseChan <- d.commitTx(tx)
+		case n := <-d.stageChan:
+			d.stageResponseChan <- d.stage(n)
+		case req := <-d.appendChan:
+			count++
+			d.appendResponseChan <- d.appendJournaled(req)
+		case pos := <-s:
+			d.skipResponseChan <- d.skipAt(pos, r != nil)
+		case pos := <-t:
+			count++
+			d.takeResponseChan <- d.consumeAt(pos, r != nil)
 		case dataWrite := <-d.writeChan:
 			count++
-			d.writeResponseChan <- d.writeOne(dataWrite)
+			d.writeResponseChan <- d.write(dataWrite)
+		case <-e:
+			// handled at the top of the loop
+		case <-dl:
+			// handled at the top of the loop
 		case <-syncTicker.C:
+			if d.enableRetention {
+				d.pruneRetainedFiles()
+			}
 			if count == 0 {
 				// avoid sync when there's no activity
 				continue
@@ -1060,6 +2255,14 @@ func (d *diskQueue) ioLoop() {
 
 exit:
 	d.logf(INFO, "DISKQUEUE(%s): closing ... ioLoop", d.name)
+	d.stopReadAhead()
 	syncTicker.Stop()
+	expireTimer.Stop()
+	delayTimer.Stop()
+	// tells readers that nothing is coming anymore
+	close(d.readChan)
+	close(d.peekChan)
+	close(d.headChan)
+	close(d.messageChan)
 	d.exitSyncChan <- 1
 }
@@ -1110,6 +1110,63 @@ func benchmarkDiskQueuePut(size int64, b *testing.B) {
 	}
 }
 
+func BenchmarkDiskQueuePutPreallocated16(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(16, b)
+}
+func BenchmarkDiskQueuePutPreallocated64(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(64, b)
+}
+func BenchmarkDiskQueuePutPreallocated256(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(256, b)
+}
+func BenchmarkDiskQueuePutPreallocated1024(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(1024, b)
+}
+func BenchmarkDiskQueuePutPreallocated4096(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(4096, b)
+}
+func BenchmarkDiskQueuePutPreallocated16384(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(16384, b)
+}
+func BenchmarkDiskQueuePutPreallocated65536(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(65536, b)
+}
+func BenchmarkDiskQueuePutPreallocated262144(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(262144, b)
+}
+func BenchmarkDiskQueuePutPreallocated1048576(b *testing.B) {
+	benchmarkDiskQueuePutPreallocated(1048576, b)
+}
+func benchmarkDiskQueuePutPreallocated(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_put_preallocated" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024768 * 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 20,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		Preallocate:     true,
+	}, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		err := dq.Put(data)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
 func BenchmarkDiskWrite16(b *testing.B) {
 	benchmarkDiskWrite(16, b)
 }
@@ -1261,6 +1318,123 @@ func benchmarkDiskQueueGet(size int64, b *testing.B) {
 	}
 }
 
+func BenchmarkDiskQueueGetMmap16(b *testing.B) {
+	benchmarkDiskQueueGetMmap(16, b)
+}
+func BenchmarkDiskQueueGetMmap64(b *testing.B) {
+	benchmarkDiskQueueGetMmap(64, b)
+}
+func BenchmarkDiskQueueGetMmap256(b *testing.B) {
+	benchmarkDiskQueueGetMmap(256, b)
+}
+func BenchmarkDiskQueueGetMmap1024(b *testing.B) {
+	benchmarkDiskQueueGetMmap(1024, b)
+}
+func BenchmarkDiskQueueGetMmap4096(b *testing.B) {
+	benchmarkDiskQueueGetMmap(4096, b)
+}
+func BenchmarkDiskQueueGetMmap16384(b *testing.B) {
+	benchmarkDiskQueueGetMmap(16384, b)
+}
+func BenchmarkDiskQueueGetMmap65536(b *testing.B) {
+	benchmarkDiskQueueGetMmap(65536, b)
+}
+func BenchmarkDiskQueueGetMmap262144(b *testing.B) {
+	benchmarkDiskQueueGetMmap(262144, b)
+}
+func BenchmarkDiskQueueGetMmap1048576(b *testing.B) {
+	benchmarkDiskQueueGetMmap(1048576, b)
+}
+
+func benchmarkDiskQueueGetMmap(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get_mmap" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024768,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 30,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MmapReads:       true,
+	}, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		<-dq.ReadChan()
+	}
+}
+
+func BenchmarkDiskQueueGetPooled16(b *testing.B) {
+	benchmarkDiskQueueGetPooled(16, b)
+}
+func BenchmarkDiskQueueGetPooled64(b *testing.B) {
+	benchmarkDiskQueueGetPooled(64, b)
+}
+func BenchmarkDiskQueueGetPooled256(b *testing.B) {
+	benchmarkDiskQueueGetPooled(256, b)
+}
+func BenchmarkDiskQueueGetPooled1024(b *testing.B) {
+	benchmarkDiskQueueGetPooled(1024, b)
+}
+func BenchmarkDiskQueueGetPooled4096(b *testing.B) {
+	benchmarkDiskQueueGetPooled(4096, b)
+}
+func BenchmarkDiskQueueGetPooled16384(b *testing.B) {
+	benchmarkDiskQueueGetPooled(16384, b)
+}
+func BenchmarkDiskQueueGetPooled65536(b *testing.B) {
+	benchmarkDiskQueueGetPooled(65536, b)
+}
+func BenchmarkDiskQueueGetPooled262144(b *testing.B) {
+	benchmarkDiskQueueGetPooled(262144, b)
+}
+func BenchmarkDiskQueueGetPooled1048576(b *testing.B) {
+	benchmarkDiskQueueGetPooled(1048576, b)
+}
+
+func benchmarkDiskQueueGetPooled(size int64, b *testing.B) {
+	b.StopTimer()
+	l := NewTestLogger(b)
+	dqName := "bench_disk_queue_get_pooled" + strconv.Itoa(b.N) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024768,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 30,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		PoolBuffers:     true,
+	}, l)
+	defer dq.Close()
+	b.SetBytes(size)
+	data := make([]byte, size)
+	for i := 0; i < b.N; i++ {
+		dq.Put(data)
+	}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := <-dq.(MessageReader).MessageChan()
+		msg.Release()
+	}
+}
+
 func TestDiskQueuePeek(t *testing.T) {
 	l := NewTestLogger(t)
 	dqName := "test_disk_queue_peek" + strconv.Itoa(int(time.Now().Unix()))
@@ -1337,3 +1511,295 @@ func TestDiskQueuePeek(t *testing.T) {
 	})
 
 }
+
+func TestDiskQueueRetentionRewind(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_retention_rewind" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		RetentionPeriod: time.Hour,
+	}, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	for i := 0; i < 10; i++ {
+		msg[0] = byte(i)
+		Nil(t, dq.Put(msg))
+	}
+	time.Sleep(10 * time.Millisecond)
+	middle := time.Now()
+	for i := 10; i < 20; i++ {
+		msg[0] = byte(i)
+		Nil(t, dq.Put(msg))
+	}
+
+	for i := 0; i < 20; i++ {
+		msg[0] = byte(i)
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	// consumed files are kept around
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+
+	Nil(t, dq.(Rewinder).RewindTo(middle))
+	Equal(t, int64(10), dq.Depth())
+	for i := 10; i < 20; i++ {
+		msg[0] = byte(i)
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	Nil(t, dq.(Rewinder).RewindTo(time.Time{}))
+	Equal(t, int64(20), dq.Depth())
+	for i := 0; i < 20; i++ {
+		msg[0] = byte(i)
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	// nothing was written after now
+	Nil(t, dq.(Rewinder).RewindTo(time.Now()))
+	Equal(t, int64(0), dq.Depth())
+
+	Nil(t, dq.Empty())
+	_, err = os.Stat(dq.(*diskQueue).fileName(0))
+	Equal(t, true, os.IsNotExist(err))
+
+	noRetention := New(dqName+"_none", tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, ErrRetentionDisabled, noRetention.(Rewinder).RewindTo(time.Time{}))
+	noRetention.Close()
+}
+
+func TestDiskQueueRetentionBytes(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_retention_bytes" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := make([]byte, 10)
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		RetentionBytes:  250,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	// 23 bytes per message, 5 messages (115 bytes) per file
+	for i := 0; i < 25; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	for i := 0; i < 25; i++ {
+		<-dq.ReadChan()
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	// only the two most recent consumed files fit within RetentionBytes
+	Equal(t, int64(5), dq.(*diskQueue).readFileNum)
+	Equal(t, int64(3), dq.(*diskQueue).retainedFileNum)
+	for i := int64(0); i < 3; i++ {
+		assertFileNotExist(t, dq.(*diskQueue).fileName(i))
+	}
+
+	// retained files are found again after a restart
+	dq.Close()
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	defer dq.Close()
+	Equal(t, int64(3), dq.(*diskQueue).retainedFileNum)
+
+	Nil(t, dq.(Rewinder).RewindTo(time.Time{}))
+	Equal(t, int64(10), dq.Depth())
+	for i := 0; i < 10; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueRetentionWithDiskSizeLimit(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_retention_disk_size_limit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	msg := make([]byte, 10)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesDiskSpace: 400,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		RetentionPeriod:   time.Hour,
+	}, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	// 23 bytes per message, 4 messages and their count (100 bytes) per file
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	for i := 0; i < 10; i++ {
+		<-dq.ReadChan()
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(0), dq.(*diskQueue).retainedFileNum)
+	Equal(t, int64(2), dq.(*diskQueue).readFileNum)
+
+	// the oldest retained file makes space before any unread data
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, int64(1), dq.(*diskQueue).retainedFileNum)
+	assertFileNotExist(t, dq.(*diskQueue).fileName(0))
+
+	// the 2nd file and the consumed part of the 3rd file are replayed
+	Nil(t, dq.(Rewinder).RewindTo(time.Time{}))
+	Equal(t, int64(11), dq.Depth())
+	for i := 0; i < 11; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestDiskQueueTTL(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_ttl" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var expired int64
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		OnExpire: func(data []byte) {
+			atomic.AddInt64(&expired, 1)
+		},
+	}, l)
+	defer dq.Close()
+	NotNil(t, dq)
+
+	Nil(t, dq.(TTLPutter).PutWithTTL([]byte("stale"), time.Millisecond))
+	Nil(t, dq.(TTLPutter).PutWithTTL([]byte("fresh"), time.Hour))
+	Nil(t, dq.Put([]byte("forever")))
+	Equal(t, int64(3), dq.Depth())
+
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, []byte("fresh"), <-dq.ReadChan())
+	Equal(t, []byte("forever"), <-dq.ReadChan())
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(1), atomic.LoadInt64(&expired))
+}
+
+func TestDiskQueueMaxMsgAge(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_msg_age" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	var expired int64
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxMsgAge:       50 * time.Millisecond,
+		OnExpire: func(data []byte) {
+			atomic.AddInt64(&expired, 1)
+		},
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	// spans several files
+	msg := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	dq.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// every message expired while the queue was closed
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	defer dq.Close()
+
+	Nil(t, dq.(TTLPutter).PutWithTTL([]byte("fresh"), time.Hour))
+	Equal(t, []byte("fresh"), <-dq.ReadChan())
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(10), atomic.LoadInt64(&expired))
+}
+
+func TestDiskQueueMmapReads(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_mmap_reads" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		opts := Options{
+			MaxBytesDiskSpace: diskLimit,
+			MaxBytesPerFile:   100,
+			MinMsgSize:        0,
+			MaxMsgSize:        1 << 10,
+			SyncEvery:         2500,
+			SyncTimeout:       2 * time.Second,
+			MmapReads:         true,
+		}
+		name := dqName + strconv.Itoa(int(diskLimit))
+		dq := NewWithOptions(name, tmpDir, opts, l)
+		NotNil(t, dq)
+
+		// spans several complete files and the one being written to
+		for i := 0; i < 30; i++ {
+			Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		}
+		dq.Close()
+
+		// the files were completed before reading them began
+		dq = NewWithOptions(name, tmpDir, opts, l)
+		for i := 0; i < 5; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		Equal(t, int64(25), dq.Depth())
+		Equal(t, true, dq.(*diskQueue).readMmap != nil)
+		dq.Close()
+
+		// picks up mid file after a restart
+		dq = NewWithOptions(name, tmpDir, opts, l)
+		Equal(t, int64(25), dq.Depth())
+		for i := 5; i < 30; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		Equal(t, int64(0), dq.Depth())
+		dq.Close()
+	}
+}
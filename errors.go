@@ -0,0 +1,47 @@
+package diskqueue
+
+import (
+	"errors"
+)
+
+var (
+	// ErrClosed is returned by the methods of a queue that was closed
+	ErrClosed = errors.New("queue is closed")
+
+	// ErrMsgSize is returned, wrapped along with the sizes involved, for a
+	// message that is out of MinMsgSize and MaxMsgSize or that could never
+	// fit within MaxBytesDiskSpace
+	ErrMsgSize = errors.New("invalid message size")
+
+	// ErrDiskFull is returned by writes that found MaxBytesDiskSpace reached,
+	// unless FullEvictOldest is used
+	ErrDiskFull = errors.New("disk space limit reached")
+
+	// ErrQueueFull is returned by writes that found MaxDepth reached, unless
+	// FullEvictOldest is used
+	ErrQueueFull = errors.New("queue is full")
+
+	// ErrRetentionDisabled is returned by RewindTo() on a queue that was
+	// created without RetentionPeriod or RetentionBytes
+	ErrRetentionDisabled = errors.New("retention is not enabled")
+
+	// ErrReplicaAcks is returned, wrapped along with the acks received, by a
+	// Put() whose message was written but not acked by ReplicaAcks followers
+	// within ReplicaAckTimeout
+	ErrReplicaAcks = errors.New("not acked by enough followers")
+)
+
+// remoteError is an error received from a server, it keeps the server's
+// message and matches the sentinel error the server returned
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,13 @@
+//go:build linux
+// +build linux
+
+package diskqueue
+
+import (
+	"syscall"
+)
+
+// fallocate allocates the first size bytes of f, extending it with zeros
+func fallocate(f File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
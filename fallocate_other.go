@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package diskqueue
+
+import (
+	"errors"
+)
+
+// fallocate always fails on this platform so that files grow as they are
+// written to
+func fallocate(f File, size int64) error {
+	return errors.New("fallocate is not supported on this platform")
+}
@@ -0,0 +1,305 @@
+package diskqueue
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// FaultOp is a kind of call made through an FS or one of its Files
+type FaultOp int
+
+const (
+	OpOpen     FaultOp = iota // FS.OpenFile
+	OpRename                  // FS.Rename
+	OpRemove                  // FS.Remove
+	OpStat                    // FS.Stat
+	OpReadDir                 // FS.ReadDir
+	OpTruncate                // FS.Truncate and File.Truncate
+	OpRead                    // File.Read and File.ReadAt
+	OpWrite                   // File.Write and File.WriteAt
+	OpSync                    // File.Sync
+	OpClose                   // File.Close, which closes the file anyway
+	OpMkdir                   // FS.MkdirAll
+)
+
+// Fault describes the calls a FaultFS fails or corrupts
+type Fault struct {
+	Op FaultOp
+	// only calls on the files whose name contains Path, every file if empty
+	Path string
+	// number of matching calls that go through before the fault is injected
+	After int
+	// number of calls the fault is injected into, every following one if 0
+	Times int
+
+	// returned by the calls, which do nothing unless Short or Corrupt is set
+	Err error
+	// reads and writes only handle the first half of their data, returning
+	// Err (or io.ErrShortWrite for writes and io.ErrUnexpectedEOF for
+	// ReadAt when Err is nil)
+	Short bool
+	// reads and writes go through with every bit of their data flipped
+	Corrupt bool
+}
+
+// FaultFS is an FS that injects faults into the calls made through it, e.g.
+// to test how a queue behaves on ENOSPC, EIO on fsync or a failed rename
+//
+// reads of files mapped into memory (see Options.MmapReads) do not go
+// through File.Read and so are not faulted
+type FaultFS struct {
+	sync.Mutex
+
+	fs     FS
+	faults []*faultState
+}
+
+type faultState struct {
+	Fault
+	seen     int
+	injected int
+}
+
+// NewFaultFS returns a FaultFS on top of fs, injecting no fault until
+// Inject() is called
+func NewFaultFS(fs FS) *FaultFS {
+	return &FaultFS{fs: fs}
+}
+
+// Inject adds a fault, faults are matched in the order they were added
+func (ffs *FaultFS) Inject(fault Fault) {
+	ffs.Lock()
+	defer ffs.Unlock()
+
+	ffs.faults = append(ffs.faults, &faultState{Fault: fault})
+}
+
+// Clear removes every fault
+func (ffs *FaultFS) Clear() {
+	ffs.Lock()
+	defer ffs.Unlock()
+
+	ffs.faults = nil
+}
+
+// Injected returns the number of calls faults were injected into since they
+// were last cleared
+func (ffs *FaultFS) Injected() int {
+	ffs.Lock()
+	defer ffs.Unlock()
+
+	var n int
+	for _, fs := range ffs.faults {
+		n += fs.injected
+	}
+	return n
+}
+
+// match returns the fault to inject into a call of op on name, if any
+func (ffs *FaultFS) match(op FaultOp, name string) (Fault, bool) {
+	ffs.Lock()
+	defer ffs.Unlock()
+
+	for _, fs := range ffs.faults {
+		if fs.Op != op || !strings.Contains(name, fs.Path) {
+			continue
+		}
+		fs.seen++
+		if fs.seen <= fs.After || (fs.Times > 0 && fs.injected >= fs.Times) {
+			continue
+		}
+		fs.injected++
+		return fs.Fault, true
+	}
+	return Fault{}, false
+}
+
+func (ffs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if fault, ok := ffs.match(OpOpen, name); ok && fault.Err != nil {
+		return nil, fault.Err
+	}
+	f, err := ffs.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: f, ffs: ffs}, nil
+}
+
+func (ffs *FaultFS) Rename(oldpath, newpath string) error {
+	if fault, ok := ffs.match(OpRename, oldpath); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return ffs.fs.Rename(oldpath, newpath)
+}
+
+func (ffs *FaultFS) Remove(name string) error {
+	if fault, ok := ffs.match(OpRemove, name); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return ffs.fs.Remove(name)
+}
+
+func (ffs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if fault, ok := ffs.match(OpStat, name); ok && fault.Err != nil {
+		return nil, fault.Err
+	}
+	return ffs.fs.Stat(name)
+}
+
+func (ffs *FaultFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	if fault, ok := ffs.match(OpReadDir, dirname); ok && fault.Err != nil {
+		return nil, fault.Err
+	}
+	return ffs.fs.ReadDir(dirname)
+}
+
+func (ffs *FaultFS) Truncate(name string, size int64) error {
+	if fault, ok := ffs.match(OpTruncate, name); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return ffs.fs.Truncate(name, size)
+}
+
+func (ffs *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if fault, ok := ffs.match(OpMkdir, path); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return ffs.fs.MkdirAll(path, perm)
+}
+
+// faultFile is a File opened through a FaultFS
+type faultFile struct {
+	File
+	ffs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	fault, ok := f.ffs.match(OpRead, f.Name())
+	if !ok {
+		return f.File.Read(p)
+	}
+	if !fault.Short && !fault.Corrupt {
+		return 0, fault.Err
+	}
+
+	if fault.Short {
+		p = p[:len(p)/2]
+	}
+	n, err := f.File.Read(p)
+	if fault.Corrupt {
+		flipBits(p[:n])
+	}
+	if fault.Err != nil {
+		err = fault.Err
+	}
+	return n, err
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	fault, ok := f.ffs.match(OpRead, f.Name())
+	if !ok {
+		return f.File.ReadAt(p, off)
+	}
+	if !fault.Short && !fault.Corrupt {
+		return 0, fault.Err
+	}
+
+	short := p
+	if fault.Short {
+		short = p[:len(p)/2]
+	}
+	n, err := f.File.ReadAt(short, off)
+	if fault.Corrupt {
+		flipBits(short[:n])
+	}
+	if fault.Err != nil {
+		err = fault.Err
+	} else if err == nil && n < len(p) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault, ok := f.ffs.match(OpWrite, f.Name())
+	if !ok {
+		return f.File.Write(p)
+	}
+	if !fault.Short && !fault.Corrupt {
+		return 0, fault.Err
+	}
+
+	p, err := faultData(p, fault)
+	n, writeErr := f.File.Write(p)
+	if writeErr != nil {
+		err = writeErr
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	fault, ok := f.ffs.match(OpWrite, f.Name())
+	if !ok {
+		return f.File.WriteAt(p, off)
+	}
+	if !fault.Short && !fault.Corrupt {
+		return 0, fault.Err
+	}
+
+	p, err := faultData(p, fault)
+	n, writeErr := f.File.WriteAt(p, off)
+	if writeErr != nil {
+		err = writeErr
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if fault, ok := f.ffs.match(OpSync, f.Name()); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault, ok := f.ffs.match(OpTruncate, f.Name()); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	err := f.File.Close()
+	if fault, ok := f.ffs.match(OpClose, f.Name()); ok && fault.Err != nil {
+		return fault.Err
+	}
+	return err
+}
+
+// faultData returns the part of p a faulted write writes, along with the
+// error it returns
+func faultData(p []byte, fault Fault) ([]byte, error) {
+	err := fault.Err
+	if fault.Short {
+		p = p[:len(p)/2]
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+	}
+	if fault.Corrupt {
+		// the caller's buffer is left alone
+		corrupt := make([]byte, len(p))
+		copy(corrupt, p)
+		flipBits(corrupt)
+		p = corrupt
+	}
+	return p, err
+}
+
+func flipBits(p []byte) {
+	for i := range p {
+		p[i] ^= 0xff
+	}
+}
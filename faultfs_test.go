@@ -0,0 +1,163 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultFSShortWrite(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_fault_fs_short_write" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}, l)
+	NotNil(t, dq)
+
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+
+	// the disk fills up halfway through the message
+	ffs.Inject(Fault{Op: OpWrite, Path: ".diskqueue.000000.dat", Times: 1, Short: true, Err: syscall.ENOSPC})
+	err = dq.Put([]byte("cccccccccc"))
+	Equal(t, true, errors.Is(err, syscall.ENOSPC))
+	Equal(t, 1, ffs.Injected())
+	Equal(t, int64(2), dq.Depth())
+
+	// the part that was written does not end up in front of the next message
+	Nil(t, dq.Put([]byte("d")))
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	Equal(t, []byte("b"), <-dq.ReadChan())
+	Equal(t, []byte("d"), <-dq.ReadChan())
+	Nil(t, dq.Close())
+
+	stat, err := os.Stat(dq.(*diskQueue).fileName(0))
+	Nil(t, err)
+	Equal(t, int64(15), stat.Size())
+}
+
+func TestFaultFSMetaDataSync(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_fault_fs_meta_data_sync" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}, l)
+	NotNil(t, dq)
+
+	Nil(t, dq.Put([]byte("a")))
+	ffs.Inject(Fault{Op: OpSync, Path: ".meta.dat", Err: syscall.EIO})
+	err = dq.Close()
+	Equal(t, true, errors.Is(err, syscall.EIO))
+
+	// the metadata that could not be made durable is not left behind
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.tmp"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+	_, err = os.Stat(dq.(*diskQueue).metaDataFileName())
+	Equal(t, true, os.IsNotExist(err))
+}
+
+func TestFaultFSMetaDataRename(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_fault_fs_meta_data_rename" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+	Nil(t, dq.Close())
+
+	ffs := NewFaultFS(OSFS{})
+	dq = NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}, l)
+	NotNil(t, dq)
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	ffs.Inject(Fault{Op: OpRename, Path: ".meta.dat", Err: syscall.EACCES})
+	err = dq.Close()
+	Equal(t, true, errors.Is(err, syscall.EACCES))
+
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.tmp"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+
+	// the previous metadata is intact, so the message is read again
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	Equal(t, int64(2), dq.Depth())
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	Equal(t, []byte("b"), <-dq.ReadChan())
+	dq.Close()
+}
+
+func TestFaultFSCorruptRead(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_fault_fs_corrupt_read" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// each message gets a file of its own
+	dq := New(dqName, tmpDir, 5, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+	Nil(t, dq.Close())
+
+	ffs := NewFaultFS(OSFS{})
+	ffs.Inject(Fault{Op: OpRead, Path: ".diskqueue.000000.dat", Corrupt: true})
+	dq = NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 5,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}, l)
+	NotNil(t, dq)
+
+	// the first file reads back as garbage and is set aside
+	Equal(t, []byte("b"), <-dq.ReadChan())
+	Equal(t, true, ffs.Injected() > 0)
+	_, err = os.Stat(dq.(*diskQueue).fileName(0) + ".bad")
+	Nil(t, err)
+	dq.Close()
+}
@@ -0,0 +1,90 @@
+package diskqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MessagePutter is implemented by queues that can store headers along with
+// a message, they are received back from MessageChan() (see MessageReader)
+type MessagePutter interface {
+	PutMessage(m Message) error
+}
+
+// PutMessage writes m.Body to the queue along with m.Headers
+//
+// messages without headers are stored like the ones written by Put()
+func (d *diskQueue) PutMessage(m Message) error {
+	if len(m.Headers) > 0 {
+		size := 0
+		for key, value := range m.Headers {
+			if len(key) > math.MaxUint16 {
+				return fmt.Errorf("%w: header key size (%d)", ErrMsgSize, len(key))
+			}
+			size += 6 + len(key) + len(value)
+		}
+		if size > int(d.maxMsgSize) {
+			return fmt.Errorf("%w: headers write size (%d) maxMsgSize=%d", ErrMsgSize, size, d.maxMsgSize)
+		}
+	}
+	return d.put(frame{data: m.Body, headers: m.Headers})
+}
+
+// encodeHeaders encodes headers sorted by key, each as a big endian uint16
+// key size, the key, a big endian uint32 value size and the value
+func encodeHeaders(headers map[string][]byte) []byte {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	var scratch [4]byte
+	for _, key := range keys {
+		binary.BigEndian.PutUint16(scratch[:2], uint16(len(key)))
+		buf.Write(scratch[:2])
+		buf.WriteString(key)
+		binary.BigEndian.PutUint32(scratch[:], uint32(len(headers[key])))
+		buf.Write(scratch[:])
+		buf.Write(headers[key])
+	}
+	return buf.Bytes()
+}
+
+// decodeHeaders decodes headers encoded by encodeHeaders, the values share
+// the memory of encoded
+func decodeHeaders(encoded []byte) (map[string][]byte, error) {
+	errCorrupt := errors.New("corrupt headers")
+
+	headers := make(map[string][]byte)
+	for len(encoded) > 0 {
+		if len(encoded) < 2 {
+			return nil, errCorrupt
+		}
+		keySize := int(binary.BigEndian.Uint16(encoded))
+		encoded = encoded[2:]
+		if len(encoded) < keySize+4 {
+			return nil, errCorrupt
+		}
+		key := string(encoded[:keySize])
+		encoded = encoded[keySize:]
+
+		valueSize := int64(binary.BigEndian.Uint32(encoded))
+		encoded = encoded[4:]
+		if int64(len(encoded)) < valueSize {
+			return nil, errCorrupt
+		}
+		headers[key] = encoded[:valueSize:valueSize]
+		encoded = encoded[valueSize:]
+	}
+	return headers, nil
+}
@@ -0,0 +1,103 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeadersEncoding(t *testing.T) {
+	headers := map[string][]byte{
+		"trace-id":     []byte("abc"),
+		"content-type": []byte("application/json"),
+		"\x00\xff":     {0, 1, 2},
+		"empty":        {},
+	}
+	encoded := encodeHeaders(headers)
+	decoded, err := decodeHeaders(encoded)
+	Nil(t, err)
+	Equal(t, headers, decoded)
+	// the encoding does not depend on the map iteration order
+	Equal(t, encoded, encodeHeaders(decoded))
+
+	Nil(t, encodeHeaders(nil))
+	_, err = decodeHeaders(encoded[:len(encoded)-1])
+	NotNil(t, err)
+	_, err = decodeHeaders([]byte{0, 5, 'a'})
+	NotNil(t, err)
+}
+
+func TestDiskQueueHeaders(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_headers" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	headers := map[string][]byte{"routing-key": []byte("eu"), "trace-id": {1, 2, 3}}
+	for i := 0; i < 30; i++ {
+		if i%2 == 0 {
+			Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		} else {
+			Nil(t, dq.(MessagePutter).PutMessage(Message{Headers: headers, Body: []byte(strconv.Itoa(i))}))
+		}
+	}
+	Equal(t, true, errors.Is(dq.(MessagePutter).PutMessage(Message{Headers: map[string][]byte{"a": make([]byte, 2<<10)}}), ErrMsgSize))
+	Equal(t, true, errors.Is(dq.(MessagePutter).PutMessage(Message{Headers: map[string][]byte{string(make([]byte, 1<<16)): nil}}), ErrMsgSize))
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("delayed"), time.Now().Add(10*time.Millisecond)))
+	Equal(t, int64(31), dq.Depth())
+	dq.Close()
+
+	// headers survive a restart, and messages without them are unchanged
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	for i := 0; i < 30; i++ {
+		if i%3 == 0 {
+			// ReadChan() only hands out the message
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+			continue
+		}
+		msg := <-dq.(MessageReader).MessageChan()
+		Equal(t, []byte(strconv.Itoa(i)), msg.Body)
+		if i%2 == 0 {
+			Equal(t, 0, len(msg.Headers))
+		} else {
+			Equal(t, headers, msg.Headers)
+		}
+	}
+	Equal(t, []byte("delayed"), <-dq.ReadChan())
+	Equal(t, int64(0), dq.Depth())
+	dq.Close()
+}
+
+func TestDiskQueueHeadersFormat(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_headers_format" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	// messages without headers keep the plain length prefixed format
+	Nil(t, dq.Put([]byte("abc")))
+	Nil(t, dq.(MessagePutter).PutMessage(Message{Body: []byte("de")}))
+	Nil(t, dq.(MessagePutter).PutMessage(Message{Headers: map[string][]byte{"k": []byte("v")}, Body: []byte("f")}))
+	fileName := dq.(*diskQueue).fileName(0)
+	dq.Close()
+
+	data, err := ioutil.ReadFile(fileName)
+	Nil(t, err)
+	Equal(t, []byte{0, 0, 0, 3, 'a', 'b', 'c', 0, 0, 0, 2, 'd', 'e'}, data[:13])
+	// -(flags + headers size + headers + message)
+	Equal(t, []byte{0xff, 0xff, 0xff, 0xf2, frameFlagHeaders, 0, 0, 0, 8, 0, 1, 'k', 0, 0, 0, 1, 'v', 'f'}, data[13:])
+}
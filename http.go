@@ -0,0 +1,600 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPollTimeout is how long get and peek wait for a message when the
+// request does not say
+const defaultPollTimeout = 30 * time.Second
+
+// maxPollTimeout caps how long get and peek requests wait for a message
+const maxPollTimeout = 5 * time.Minute
+
+// httpHandler exposes a queue over HTTP
+type httpHandler struct {
+	queue       Interface
+	maxBodySize int64
+	logf        AppLogFunc
+
+	// queue, if it is a Diskqueue, whose head is taken by its position once
+	// it was sent. getSem lets a single get request at a time hold it
+	dq     *diskQueue
+	getSem chan int
+}
+
+// httpStats is the body of the stats endpoint
+type httpStats struct {
+	Depth                int64 `json:"depth"`
+	TotalBytesFolderSize int64 `json:"total_bytes_folder_size"`
+}
+
+// NewHTTPHandler exposes queue over HTTP, the last element of the request
+// path selects the endpoint:
+//
+//   POST put       the body is the message
+//   POST mput      the body is messages separated by newlines, or with
+//                  ?binary=true a big endian int32 count followed by each
+//                  message prefixed with its int32 size
+//   GET  get       the body of the response is the next message, which is
+//                  removed from the queue
+//   GET  peek      like get, without removing the message
+//   GET  depth     the body of the response is the depth
+//   POST empty     removes every message
+//   GET  stats     the depth and the size of the files as JSON
+//
+// get and peek wait for up to ?timeout (a time.Duration, 30s by default) for
+// a message and respond with 204 No Content if none arrived. When queue is a
+// Diskqueue, get only removes a message once its response was written, so a
+// message whose response failed is handed out again. Any other queue has
+// the message removed as soon as it was received from its ReadChan(), and
+// loses it if the response cannot be written. Request bodies larger than
+// maxBodySize are refused, 0 means no limit
+//
+// a put refused for its size gets 413 Request Entity Too Large, one refused
+// by MaxDepth or by a closed queue 503 Service Unavailable and one refused
+// by MaxBytesDiskSpace 507 Insufficient Storage
+func NewHTTPHandler(queue Interface, maxBodySize int64, logf AppLogFunc) http.Handler {
+	dq, _ := queue.(*diskQueue)
+	return &httpHandler{
+		queue:       queue,
+		maxBodySize: maxBodySize,
+		logf:        logf,
+		dq:          dq,
+		getSem:      make(chan int, 1),
+	}
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	endpoint := path.Base(req.URL.Path)
+
+	var method string
+	switch endpoint {
+	case "put", "mput", "empty":
+		method = http.MethodPost
+	case "get", "peek", "depth", "stats":
+		method = http.MethodGet
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch endpoint {
+	case "put":
+		h.put(w, req)
+	case "mput":
+		h.mput(w, req)
+	case "get":
+		if h.dq != nil {
+			h.get(w, req)
+		} else {
+			h.poll(w, req, h.queue.ReadChan())
+		}
+	case "peek":
+		h.poll(w, req, h.queue.PeekChan())
+	case "depth":
+		fmt.Fprintf(w, "%d", h.queue.Depth())
+	case "empty":
+		err := h.queue.Empty()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(httpStats{
+			Depth:                h.queue.Depth(),
+			TotalBytesFolderSize: h.queue.TotalBytesFolderSize(),
+		})
+	}
+}
+
+// body returns the body of req, limited to maxBodySize
+func (h *httpHandler) body(w http.ResponseWriter, req *http.Request) io.Reader {
+	if h.maxBodySize <= 0 {
+		return req.Body
+	}
+	return http.MaxBytesReader(w, req.Body, h.maxBodySize)
+}
+
+func (h *httpHandler) put(w http.ResponseWriter, req *http.Request) {
+	data, err := ioutil.ReadAll(h.body(w, req))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	err = h.queue.Put(data)
+	if err != nil {
+		http.Error(w, err.Error(), putStatus(err))
+	}
+}
+
+// putStatus returns the status of the response to a put that failed with err
+func putStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrMsgSize):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrQueueFull), errors.Is(err, ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrDiskFull):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// statusError returns the sentinel error behind a status set by putStatus,
+// ErrClosed is told apart from ErrQueueFull by its message
+func statusError(status int, msg string) error {
+	switch status {
+	case http.StatusRequestEntityTooLarge:
+		return ErrMsgSize
+	case http.StatusServiceUnavailable:
+		if strings.Contains(msg, ErrClosed.Error()) {
+			return ErrClosed
+		}
+		return ErrQueueFull
+	case http.StatusInsufficientStorage:
+		return ErrDiskFull
+	default:
+		return nil
+	}
+}
+
+// mput puts every message of the body in order, if one fails the ones
+// before it stay in the queue and their number is part of the error
+func (h *httpHandler) mput(w http.ResponseWriter, req *http.Request) {
+	body := h.body(w, req)
+
+	var msgs [][]byte
+	var err error
+	if req.URL.Query().Get("binary") == "true" {
+		msgs, err = readBinaryBatch(body)
+	} else {
+		msgs, err = readLineBatch(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i, msg := range msgs {
+		err = h.queue.Put(msg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("put %d of %d messages - %s", i, len(msgs), err),
+				putStatus(err))
+			return
+		}
+	}
+}
+
+func readLineBatch(r io.Reader) ([][]byte, error) {
+	var msgs [][]byte
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			msgs = append(msgs, line)
+		}
+		if err == io.EOF {
+			return msgs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readBinaryBatch(r io.Reader) ([][]byte, error) {
+	var scratch [4]byte
+	_, err := io.ReadFull(r, scratch[:])
+	if err != nil {
+		return nil, err
+	}
+	count := int32(binary.BigEndian.Uint32(scratch[:]))
+	if count < 0 {
+		return nil, fmt.Errorf("invalid message count (%d)", count)
+	}
+
+	var msgs [][]byte
+	for i := int32(0); i < count; i++ {
+		_, err = io.ReadFull(r, scratch[:])
+		if err != nil {
+			return nil, err
+		}
+		size := int32(binary.BigEndian.Uint32(scratch[:]))
+		if size < 0 {
+			return nil, fmt.Errorf("invalid message size (%d)", size)
+		}
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// pollTimeout returns how long a get or peek request waits for a message,
+// responding with 400 Bad Request if it cannot be parsed
+func pollTimeout(w http.ResponseWriter, req *http.Request) (time.Duration, bool) {
+	timeout := defaultPollTimeout
+	if s := req.URL.Query().Get("timeout"); s != "" {
+		var err error
+		timeout, err = time.ParseDuration(s)
+		if err != nil || timeout < 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout (%s)", s), http.StatusBadRequest)
+			return 0, false
+		}
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+	return timeout, true
+}
+
+// get waits for the head of dq until the timeout of the request passed or
+// the client went away, and takes it once the response was written
+//
+// the head is offered until it is taken, so get requests hold it one at a
+// time rather than all responding with the same message
+func (h *httpHandler) get(w http.ResponseWriter, req *http.Request) {
+	timeout, ok := pollTimeout(w, req)
+	if !ok {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.getSem <- 1:
+		defer func() { <-h.getSem }()
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-req.Context().Done():
+		return
+	}
+
+	select {
+	case hd, ok := <-h.dq.headChan:
+		if !ok {
+			http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err := w.Write(hd.data)
+		if err != nil {
+			h.logf(WARN, "HTTP: failed to send message to %s - %s", req.RemoteAddr, err)
+			return
+		}
+		err = h.dq.take(hd.pos)
+		if err != nil {
+			h.logf(ERROR, "HTTP: failed to consume message sent to %s - %s", req.RemoteAddr, err)
+		}
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-req.Context().Done():
+	}
+}
+
+// poll waits for a message from c until the timeout of the request passed or
+// the client went away
+func (h *httpHandler) poll(w http.ResponseWriter, req *http.Request, c <-chan []byte) {
+	timeout, ok := pollTimeout(w, req)
+	if !ok {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data, ok := <-c:
+		if !ok {
+			http.Error(w, ErrClosed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err := w.Write(data)
+		if err != nil {
+			h.logf(WARN, "HTTP: failed to send message to %s - %s", req.RemoteAddr, err)
+		}
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-req.Context().Done():
+	}
+}
+
+// httpClient implements Interface on top of a queue exposed by
+// NewHTTPHandler()
+type httpClient struct {
+	sync.RWMutex
+
+	baseURL     string
+	client      *http.Client
+	pollTimeout time.Duration
+	exitFlag    int32
+
+	logf AppLogFunc
+
+	// exposed via ReadChan() and PeekChan(), fed once they are first used
+	readChan    chan []byte
+	peekChan    chan []byte
+	readPolling sync.Once
+	peekPolling sync.Once
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waitGrp sync.WaitGroup
+
+	// exposed via Done()
+	doneChan chan struct{}
+}
+
+// NewHTTPClient returns a queue backed by the queue served by NewHTTPHandler()
+// at baseURL, e.g. http://localhost:4151/queues/events/
+//
+// ReadChan() and PeekChan() long-poll for up to pollTimeout. A message that
+// was received from the server but not yet from ReadChan() is lost by
+// Close(). Close() and Delete() only stop the client, the queue is owned by
+// the server
+func NewHTTPClient(baseURL string, client *http.Client, pollTimeout time.Duration, logf AppLogFunc) Interface {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &httpClient{
+		baseURL:     baseURL,
+		client:      client,
+		pollTimeout: pollTimeout,
+		logf:        logf,
+		readChan:    make(chan []byte),
+		peekChan:    make(chan []byte),
+		ctx:         ctx,
+		cancel:      cancel,
+		doneChan:    make(chan struct{}),
+	}
+}
+
+// do sends a request to endpoint and returns the body of a 200 or 204
+// response, anything else is an error
+func (c *httpClient) do(method string, endpoint string, query url.Values, body []byte) ([]byte, int, error) {
+	u := c.baseURL + endpoint
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		msg := strings.TrimSpace(string(data))
+		err = fmt.Errorf("%s %s: %s - %s", method, endpoint, resp.Status, msg)
+		if sentinel := statusError(resp.StatusCode, msg); sentinel != nil {
+			err = &remoteError{msg: err.Error(), err: sentinel}
+		}
+		return nil, resp.StatusCode, err
+	}
+	return data, resp.StatusCode, nil
+}
+
+// Put writes a []byte to the remote queue
+func (c *httpClient) Put(data []byte) error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	_, _, err := c.do(http.MethodPost, "put", nil, data)
+	return err
+}
+
+// ReadChan returns the receive-only []byte channel for reading data, it is
+// closed by Close() and Delete()
+func (c *httpClient) ReadChan() <-chan []byte {
+	c.readPolling.Do(func() { c.startPolling("get", c.readChan) })
+	return c.readChan
+}
+
+func (c *httpClient) PeekChan() <-chan []byte {
+	c.peekPolling.Do(func() { c.startPolling("peek", c.peekChan) })
+	return c.peekChan
+}
+
+func (c *httpClient) startPolling(endpoint string, out chan []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.exitFlag == 1 {
+		return
+	}
+
+	c.waitGrp.Add(1)
+	go c.pollLoop(endpoint, out)
+}
+
+// pollLoop feeds out with the messages long-polled from endpoint
+func (c *httpClient) pollLoop(endpoint string, out chan []byte) {
+	defer c.waitGrp.Done()
+
+	query := url.Values{"timeout": []string{c.pollTimeout.String()}}
+	for {
+		data, status, err := c.do(http.MethodGet, endpoint, query, nil)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			c.logf(ERROR, "HTTPCLIENT(%s) failed to %s - %s", c.baseURL, endpoint, err)
+			// back off before trying again
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+		if status == http.StatusNoContent {
+			continue
+		}
+
+		select {
+		case out <- data:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// Depth returns the depth of the remote queue, or 0 if it cannot be known
+func (c *httpClient) Depth() int64 {
+	data, _, err := c.do(http.MethodGet, "depth", nil, nil)
+	if err != nil {
+		c.logf(ERROR, "HTTPCLIENT(%s) failed to get depth - %s", c.baseURL, err)
+		return 0
+	}
+
+	depth, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		c.logf(ERROR, "HTTPCLIENT(%s) invalid depth (%s)", c.baseURL, data)
+		return 0
+	}
+	return depth
+}
+
+// Empty destructively clears out any pending data in the remote queue
+func (c *httpClient) Empty() error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if c.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	_, _, err := c.do(http.MethodPost, "empty", nil, nil)
+	return err
+}
+
+// TotalBytesFolderSize returns the size of the remote queue's files, or 0 if
+// it cannot be known
+func (c *httpClient) TotalBytesFolderSize() int64 {
+	data, _, err := c.do(http.MethodGet, "stats", nil, nil)
+	if err != nil {
+		c.logf(ERROR, "HTTPCLIENT(%s) failed to get stats - %s", c.baseURL, err)
+		return 0
+	}
+
+	var stats httpStats
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		c.logf(ERROR, "HTTPCLIENT(%s) invalid stats - %s", c.baseURL, err)
+		return 0
+	}
+	return stats.TotalBytesFolderSize
+}
+
+// Close stops the client
+func (c *httpClient) Close() error {
+	return c.exit()
+}
+
+// Delete stops the client, like Close()
+func (c *httpClient) Delete() error {
+	return c.exit()
+}
+
+// Done returns a channel that is closed once the client stopped, along with
+// ReadChan() and PeekChan()
+func (c *httpClient) Done() <-chan struct{} {
+	return c.doneChan
+}
+
+// Destroy stops the client, like Close(), as the files of the queue are
+// owned by the server
+func (c *httpClient) Destroy() error {
+	return c.exit()
+}
+
+func (c *httpClient) exit() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.exitFlag == 1 {
+		return nil
+	}
+	c.exitFlag = 1
+
+	c.cancel()
+	c.waitGrp.Wait()
+
+	// tells readers that nothing is coming anymore
+	close(c.readChan)
+	close(c.peekChan)
+	close(c.doneChan)
+
+	return nil
+}
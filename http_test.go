@@ -0,0 +1,249 @@
+package diskqueue
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func httpRequest(t *testing.T, method string, url string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	Nil(t, err)
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	Nil(t, err)
+	return resp.StatusCode, data
+}
+
+func TestHTTPHandler(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_http_handler" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	srv := httptest.NewServer(NewHTTPHandler(dq, 1<<10, l))
+	defer srv.Close()
+	url := srv.URL + "/queues/" + dqName + "/"
+
+	status, _ := httpRequest(t, "POST", url+"put", []byte("a"))
+	Equal(t, http.StatusOK, status)
+	status, _ = httpRequest(t, "POST", url+"mput", []byte("b\nc\n\nd"))
+	Equal(t, http.StatusOK, status)
+	var batch bytes.Buffer
+	writeInt32(&batch, 2)
+	writeInt32(&batch, 2)
+	batch.WriteString("e\n")
+	writeInt32(&batch, 0)
+	status, _ = httpRequest(t, "POST", url+"mput?binary=true", batch.Bytes())
+	Equal(t, http.StatusOK, status)
+
+	status, data := httpRequest(t, "GET", url+"depth", nil)
+	Equal(t, http.StatusOK, status)
+	Equal(t, "6", string(data))
+
+	status, data = httpRequest(t, "GET", url+"stats", nil)
+	Equal(t, http.StatusOK, status)
+	var stats httpStats
+	Nil(t, json.Unmarshal(data, &stats))
+	Equal(t, int64(6), stats.Depth)
+	Equal(t, dq.TotalBytesFolderSize(), stats.TotalBytesFolderSize)
+
+	status, data = httpRequest(t, "GET", url+"peek", nil)
+	Equal(t, http.StatusOK, status)
+	Equal(t, "a", string(data))
+	for _, expected := range []string{"a", "b", "c", "d", "e\n", ""} {
+		status, data = httpRequest(t, "GET", url+"get", nil)
+		Equal(t, http.StatusOK, status)
+		Equal(t, expected, string(data))
+	}
+
+	// long-polls until the timeout
+	start := time.Now()
+	status, _ = httpRequest(t, "GET", url+"get?timeout=50ms", nil)
+	Equal(t, http.StatusNoContent, status)
+	Equal(t, true, time.Since(start) >= 50*time.Millisecond)
+
+	// or until a message is put
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		dq.Put([]byte("f"))
+	}()
+	status, data = httpRequest(t, "GET", url+"get?timeout=5s", nil)
+	Equal(t, http.StatusOK, status)
+	Equal(t, "f", string(data))
+
+	Nil(t, dq.Put([]byte("g")))
+	status, _ = httpRequest(t, "POST", url+"empty", nil)
+	Equal(t, http.StatusOK, status)
+	Equal(t, int64(0), dq.Depth())
+
+	status, _ = httpRequest(t, "GET", url+"put", nil)
+	Equal(t, http.StatusMethodNotAllowed, status)
+	status, _ = httpRequest(t, "GET", url+"unknown", nil)
+	Equal(t, http.StatusNotFound, status)
+	status, _ = httpRequest(t, "GET", url+"get?timeout=soon", nil)
+	Equal(t, http.StatusBadRequest, status)
+	status, _ = httpRequest(t, "POST", url+"put", make([]byte, 2<<10))
+	Equal(t, http.StatusRequestEntityTooLarge, status)
+	status, _ = httpRequest(t, "POST", url+"mput?binary=true", []byte{0, 0})
+	Equal(t, http.StatusBadRequest, status)
+	Equal(t, int64(0), dq.Depth())
+}
+
+// failingWriter is a ResponseWriter whose client went away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestHTTPHandlerGetFailed(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_http_handler_get_failed" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	handler := NewHTTPHandler(dq, 1<<10, l)
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+
+	// a message whose response could not be written stays in the queue
+	req := httptest.NewRequest("GET", "/get?timeout=1s", nil)
+	handler.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+	Equal(t, int64(2), dq.Depth())
+
+	for _, expected := range []string{"a", "b"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/get?timeout=1s", nil))
+		Equal(t, http.StatusOK, w.Code)
+		Equal(t, expected, w.Body.String())
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	// concurrent requests do not get the same message
+	Nil(t, dq.Put([]byte("c")))
+	Nil(t, dq.Put([]byte("d")))
+	bodies := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/get?timeout=1s", nil))
+			bodies <- w.Body.String()
+		}()
+	}
+	first, second := <-bodies, <-bodies
+	Equal(t, true, first+second == "cd" || first+second == "dc")
+	Equal(t, int64(0), dq.Depth())
+}
+
+func TestHTTPHandlerPutStatus(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_http_handler_put_status" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        1,
+		FullPolicy:      FullReject,
+	}, l)
+	NotNil(t, dq)
+
+	// 0 does not limit the body, the queue refuses what it cannot hold
+	srv := httptest.NewServer(NewHTTPHandler(dq, 0, l))
+	defer srv.Close()
+
+	status, _ := httpRequest(t, "POST", srv.URL+"/put", make([]byte, 11))
+	Equal(t, http.StatusRequestEntityTooLarge, status)
+	// which the client maps back to the sentinel errors
+	q := NewHTTPClient(srv.URL, nil, 100*time.Millisecond, l)
+	defer q.Close()
+	Equal(t, true, errors.Is(q.Put(make([]byte, 11)), ErrMsgSize))
+	status, _ = httpRequest(t, "POST", srv.URL+"/put", []byte("a"))
+	Equal(t, http.StatusOK, status)
+	status, _ = httpRequest(t, "POST", srv.URL+"/put", []byte("b"))
+	Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = httpRequest(t, "POST", srv.URL+"/mput", []byte("b\nc"))
+	Equal(t, http.StatusServiceUnavailable, status)
+	Equal(t, true, errors.Is(q.Put([]byte("b")), ErrQueueFull))
+
+	dq.Close()
+	status, _ = httpRequest(t, "POST", srv.URL+"/put", []byte("a"))
+	Equal(t, http.StatusServiceUnavailable, status)
+	Equal(t, true, errors.Is(q.Put([]byte("a")), ErrClosed))
+}
+
+func TestHTTPClient(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_http_client" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	srv := httptest.NewServer(NewHTTPHandler(dq, 1<<10, l))
+	defer srv.Close()
+
+	var q Interface = NewHTTPClient(srv.URL+"/queues/"+dqName, nil, 100*time.Millisecond, l)
+
+	for i := 0; i < 10; i++ {
+		Nil(t, q.Put([]byte(strconv.Itoa(i))))
+	}
+	Equal(t, int64(10), q.Depth())
+	Equal(t, dq.TotalBytesFolderSize(), q.TotalBytesFolderSize())
+	NotNil(t, q.Put(make([]byte, 2<<10)))
+
+	Equal(t, []byte("0"), <-q.PeekChan())
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-q.ReadChan())
+	}
+
+	// keeps polling while the queue is empty
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		dq.Put([]byte("a"))
+	}()
+	Equal(t, []byte("a"), <-q.ReadChan())
+
+	Nil(t, dq.Put([]byte("b")))
+	Nil(t, q.Empty())
+	Equal(t, int64(0), q.Depth())
+
+	Nil(t, q.Close())
+	NotNil(t, q.Put([]byte("b")))
+	Equal(t, int64(0), dq.Depth())
+}
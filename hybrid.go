@@ -0,0 +1,370 @@
+package diskqueue
+
+import (
+	"errors"
+	"sync"
+)
+
+// hybridQueue implements a FIFO queue that keeps messages in memory and
+// only writes them to a backend queue when its memory buffer is full
+//
+// once the buffer fills up, everything in it is moved to the backend and
+// new messages keep going to the backend until it has been drained, so the
+// two tiers never hold messages at the same time and ordering is preserved
+type hybridQueue struct {
+	sync.RWMutex
+
+	backend      Interface
+	memSize      int
+	flushOnClose bool
+	exitFlag     int32
+
+	// backend, if it is a Diskqueue, whose head is taken by its position
+	dq *diskQueue
+
+	// only touched by ioLoop
+	mem     [][]byte
+	spilled bool // messages went to the backend, which may not be drained yet
+
+	logf AppLogFunc
+
+	// exposed via ReadChan()
+	readChan chan []byte
+
+	// exposed via PeekChan()
+	peekChan chan []byte
+
+	// internal channels
+	depthChan         chan int
+	depthResponseChan chan int64
+	writeChan         chan []byte
+	writeResponseChan chan error
+	emptyChan         chan int
+	emptyResponseChan chan error
+	exitChan          chan bool
+	exitSyncChan      chan int
+
+	// exposed via Done()
+	doneChan chan struct{}
+}
+
+// NewHybrid wraps backend with an in-memory buffer of up to memSize messages
+//
+// backend must not be read from by anything else. When flushOnClose is set,
+// Close() writes the messages still in memory to backend, otherwise they are
+// lost along with the process
+//
+// when backend was not created by this package, a message it expires or
+// evicts while its head is offered can cause the following one to be dropped,
+// and its Put() must not block when it is full. A Diskqueue backend with
+// FullBlock makes Put() wait for readers instead
+func NewHybrid(backend Interface, memSize int, flushOnClose bool, logf AppLogFunc) Interface {
+	dq, _ := backend.(*diskQueue)
+	h := hybridQueue{
+		backend:           backend,
+		memSize:           memSize,
+		flushOnClose:      flushOnClose,
+		dq:                dq,
+		logf:              logf,
+		readChan:          make(chan []byte),
+		peekChan:          make(chan []byte),
+		depthChan:         make(chan int),
+		depthResponseChan: make(chan int64),
+		writeChan:         make(chan []byte),
+		writeResponseChan: make(chan error),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		exitChan:          make(chan bool),
+		exitSyncChan:      make(chan int),
+		doneChan:          make(chan struct{}),
+		// e.g. what a previous process spilled
+		spilled: backend.Depth() > 0,
+	}
+
+	go h.ioLoop()
+
+	return &h
+}
+
+// ReadChan returns the receive-only []byte channel for reading data, it is
+// closed by Close() and Delete()
+func (h *hybridQueue) ReadChan() <-chan []byte {
+	return h.readChan
+}
+
+func (h *hybridQueue) PeekChan() <-chan []byte {
+	return h.peekChan
+}
+
+// Put writes a []byte to the queue
+//
+// with a Diskqueue backend using FullBlock, it waits for readers to make
+// room in the backend. The wait happens here rather than in ioLoop, which
+// serves the readers
+func (h *hybridQueue) Put(data []byte) error {
+	for {
+		var freed chan int
+		if h.dq != nil && h.dq.fullPolicy == FullBlock {
+			// taken before writing, so that space freed in between is not missed
+			freed = h.dq.freed()
+		}
+
+		h.RLock()
+
+		if h.exitFlag == 1 {
+			h.RUnlock()
+			return ErrClosed
+		}
+
+		h.writeChan <- data
+		err := <-h.writeResponseChan
+		h.RUnlock()
+
+		if freed == nil || !(errors.Is(err, ErrQueueFull) || errors.Is(err, ErrDiskFull)) {
+			return err
+		}
+		select {
+		case <-freed:
+		case <-h.dq.exitChan:
+			return ErrClosed
+		}
+	}
+}
+
+// Depth returns the number of messages in memory and in the backend
+func (h *hybridQueue) Depth() int64 {
+	h.RLock()
+	defer h.RUnlock()
+
+	if h.exitFlag == 1 {
+		// ioLoop exited, memory was flushed or dropped
+		return h.backend.Depth()
+	}
+
+	h.depthChan <- 1
+	return <-h.depthResponseChan
+}
+
+// Empty destructively clears out any pending data in memory and in the backend
+func (h *hybridQueue) Empty() error {
+	h.RLock()
+	defer h.RUnlock()
+
+	if h.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	h.emptyChan <- 1
+	return <-h.emptyResponseChan
+}
+
+func (h *hybridQueue) TotalBytesFolderSize() int64 {
+	return h.backend.TotalBytesFolderSize()
+}
+
+// Close flushes memory to the backend, if configured to, and closes it
+func (h *hybridQueue) Close() error {
+	return h.exit(h.flushOnClose, false)
+}
+
+// Delete drops the messages in memory and deletes the backend
+func (h *hybridQueue) Delete() error {
+	return h.exit(false, true)
+}
+
+// Done returns a channel that is closed once the backend was closed, along
+// with ReadChan() and PeekChan()
+func (h *hybridQueue) Done() <-chan struct{} {
+	return h.doneChan
+}
+
+// Destroy deletes the queue, unless it was already closed, and removes the
+// files of the backend, if it is a Lifecycle
+func (h *hybridQueue) Destroy() error {
+	h.Delete()
+	// a Close() running along may still be flushing memory
+	<-h.doneChan
+
+	lc, ok := h.backend.(Lifecycle)
+	if !ok {
+		return nil
+	}
+	return lc.Destroy()
+}
+
+func (h *hybridQueue) exit(flush bool, deleted bool) error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.exitFlag == 1 {
+		return nil
+	}
+	h.exitFlag = 1
+
+	h.exitChan <- flush
+	// ensure that ioLoop has exited
+	<-h.exitSyncChan
+
+	// tells readers that nothing is coming anymore
+	close(h.readChan)
+	close(h.peekChan)
+
+	if len(h.mem) > 0 {
+		h.logf(WARN, "HYBRIDQUEUE: dropping %d messages held in memory", len(h.mem))
+	}
+
+	var err error
+	if deleted {
+		err = h.backend.Delete()
+	} else {
+		err = h.backend.Close()
+	}
+	close(h.doneChan)
+
+	return err
+}
+
+// writeOne buffers data in memory or, once memory is full, moves everything
+// to the backend
+//
+// once messages were spilled, the backend's depth is asked for until it was
+// drained rather than tracked, as it can drop on its own when messages
+// expire or are evicted. Writes to memory do not leave ioLoop
+func (h *hybridQueue) writeOne(data []byte) error {
+	if h.spilled && h.backend.Depth() == 0 {
+		h.spilled = false
+	}
+	if !h.spilled && len(h.mem) < h.memSize {
+		h.mem = append(h.mem, data)
+		return nil
+	}
+
+	err := h.spill()
+	if err != nil {
+		return err
+	}
+
+	return h.backendPut(data)
+}
+
+// backendPut writes data to the backend, a Diskqueue backend fails instead
+// of blocking ioLoop when it is full
+func (h *hybridQueue) backendPut(data []byte) error {
+	// set even when the put fails, e.g. on a short write
+	h.spilled = true
+	if h.dq != nil {
+		return h.dq.putFrame(frame{data: data}, false)
+	}
+	return h.backend.Put(data)
+}
+
+// spill writes every message held in memory to the backend, oldest first
+func (h *hybridQueue) spill() error {
+	for len(h.mem) > 0 {
+		err := h.backendPut(h.mem[0])
+		if err != nil {
+			return err
+		}
+		h.mem[0] = nil
+		h.mem = h.mem[1:]
+	}
+	h.mem = nil
+	return nil
+}
+
+func (h *hybridQueue) emptyAll() error {
+	h.mem = nil
+	err := h.backend.Empty()
+	if err == nil {
+		h.spilled = false
+	}
+	return err
+}
+
+// ioLoop hands out the oldest message of whichever tier holds data, the
+// backend's head is only peeked at and is taken from it, by its position,
+// once it was received
+func (h *hybridQueue) ioLoop() {
+	var dataRead []byte
+	var pos Position
+	var fromDisk, ok bool
+	var r chan []byte
+	var p chan []byte
+	var dp <-chan []byte
+	var dh chan head
+
+	for {
+		r = nil
+		p = nil
+		dp = nil
+		dh = nil
+
+		if !ok {
+			if len(h.mem) > 0 {
+				dataRead = h.mem[0]
+				fromDisk = false
+				ok = true
+			} else if h.spilled {
+				// both only offer a message once there is one
+				if h.dq != nil {
+					dh = h.dq.headChan
+				} else {
+					dp = h.backend.PeekChan()
+				}
+			}
+		}
+
+		if ok {
+			r = h.readChan
+			p = h.peekChan
+		}
+
+		select {
+		case dataRead = <-dp:
+			fromDisk = true
+			ok = true
+		case hd := <-dh:
+			dataRead = hd.data
+			pos = hd.pos
+			fromDisk = true
+			ok = true
+		case p <- dataRead:
+		case r <- dataRead:
+			if h.dq != nil && fromDisk {
+				err := h.dq.take(pos)
+				if err != nil {
+					h.logf(ERROR, "HYBRIDQUEUE: failed to consume message from the backend - %s", err)
+				}
+			} else if fromDisk {
+				<-h.backend.ReadChan()
+			} else {
+				h.mem[0] = nil
+				h.mem = h.mem[1:]
+			}
+			ok = false
+		case <-h.depthChan:
+			h.depthResponseChan <- int64(len(h.mem)) + h.backend.Depth()
+		case <-h.emptyChan:
+			h.emptyResponseChan <- h.emptyAll()
+			ok = false
+		case dataWrite := <-h.writeChan:
+			h.writeResponseChan <- h.writeOne(dataWrite)
+			if !fromDisk {
+				// the offered message may have been moved to the backend
+				ok = false
+			}
+		case flush := <-h.exitChan:
+			if flush {
+				err := h.spill()
+				if err != nil {
+					h.logf(ERROR, "HYBRIDQUEUE: failed to flush memory - %s", err)
+				}
+			}
+			goto exit
+		}
+	}
+
+exit:
+	h.logf(INFO, "HYBRIDQUEUE: closing ... ioLoop")
+	h.exitSyncChan <- 1
+}
@@ -0,0 +1,232 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHybridQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_hybrid_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	hq := NewHybrid(dq, 5, false, l)
+	defer hq.Close()
+	NotNil(t, hq)
+
+	// nothing reaches the disk while memory has room
+	for i := 0; i < 5; i++ {
+		Nil(t, hq.Put([]byte{byte(i)}))
+	}
+	Equal(t, int64(5), hq.Depth())
+	Equal(t, int64(0), dq.Depth())
+
+	Equal(t, []byte{0}, <-hq.PeekChan())
+	Equal(t, []byte{0}, <-hq.ReadChan())
+
+	// the 6th message overflows memory, which is moved to disk in order
+	for i := 5; i < 20; i++ {
+		Nil(t, hq.Put([]byte{byte(i)}))
+	}
+	Equal(t, int64(19), hq.Depth())
+	Equal(t, int64(19), dq.Depth())
+
+	for i := 1; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-hq.ReadChan())
+	}
+
+	// new messages keep going to disk until it is drained
+	Nil(t, hq.Put([]byte{20}))
+	Equal(t, int64(11), dq.Depth())
+
+	for i := 10; i < 21; i++ {
+		Equal(t, []byte{byte(i)}, <-hq.ReadChan())
+	}
+	Equal(t, int64(0), hq.Depth())
+
+	Nil(t, hq.Put([]byte{21}))
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, []byte{21}, <-hq.ReadChan())
+
+	Nil(t, hq.Put([]byte{22}))
+	Nil(t, hq.Empty())
+	Equal(t, int64(0), hq.Depth())
+}
+
+func TestHybridQueueClose(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_hybrid_queue_close" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	hq := NewHybrid(New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l), 5, true, l)
+	for i := 0; i < 3; i++ {
+		Nil(t, hq.Put([]byte{byte(i)}))
+	}
+	Nil(t, hq.Close())
+
+	// flushed messages are picked up from the backend
+	hq = NewHybrid(New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l), 5, false, l)
+	Equal(t, int64(3), hq.Depth())
+	Equal(t, []byte{0}, <-hq.ReadChan())
+	Nil(t, hq.Put([]byte{3}))
+	for i := 1; i < 4; i++ {
+		Equal(t, []byte{byte(i)}, <-hq.ReadChan())
+	}
+
+	Nil(t, hq.Put([]byte{4}))
+	Nil(t, hq.Close())
+
+	// without flushing, messages in memory are lost
+	hq = NewHybrid(New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l), 5, false, l)
+	defer hq.Close()
+	Equal(t, int64(0), hq.Depth())
+}
+
+func TestHybridQueueBackendExpiry(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_hybrid_queue_backend_expiry" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxMsgAge:       200 * time.Millisecond,
+	}, l)
+	hq := NewHybrid(dq, 1, false, l)
+	NotNil(t, hq)
+
+	Nil(t, hq.Put([]byte{0}))
+	Nil(t, hq.Put([]byte{1}))
+	time.Sleep(150 * time.Millisecond)
+	Nil(t, hq.Put([]byte{2}))
+	Equal(t, int64(3), dq.Depth())
+
+	// the head that was offered expires along with the next message
+	time.Sleep(100 * time.Millisecond)
+	Equal(t, []byte{0}, <-hq.ReadChan())
+	select {
+	case msg := <-hq.ReadChan():
+		Equal(t, []byte{2}, msg)
+	case <-time.After(time.Second):
+		t.Fatal("message following the expired ones was lost")
+	}
+	Equal(t, int64(0), hq.Depth())
+
+	// new messages are kept in memory again
+	Nil(t, hq.Put([]byte{3}))
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, []byte{3}, <-hq.ReadChan())
+	hq.Close()
+}
+
+func TestHybridQueueBackendFullBlock(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_hybrid_queue_full_block" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        2,
+		FullPolicy:      FullBlock,
+	}, l)
+	hq := NewHybrid(dq, 1, false, l)
+	NotNil(t, hq)
+
+	// puts wait for the readers served by the hybrid queue
+	putErrChan := make(chan error)
+	go func() {
+		for i := 0; i < 10; i++ {
+			err := hq.Put([]byte{byte(i)})
+			if err != nil {
+				putErrChan <- err
+				return
+			}
+		}
+		putErrChan <- nil
+	}()
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-hq.ReadChan():
+			Equal(t, []byte{byte(i)}, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatal("hybrid queue deadlocked on a full backend")
+		}
+	}
+	Nil(t, <-putErrChan)
+
+	// a blocked put is released by Close()
+	for i := 0; i < 2; i++ {
+		Nil(t, hq.Put([]byte{byte(i)}))
+	}
+	go func() {
+		putErrChan <- hq.Put([]byte{2})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	hq.Close()
+	Equal(t, ErrClosed, <-putErrChan)
+}
+
+// depthCountingQueue counts the calls to Depth() of the queue it wraps
+type depthCountingQueue struct {
+	Interface
+	depthCalls int32
+}
+
+func (q *depthCountingQueue) Depth() int64 {
+	atomic.AddInt32(&q.depthCalls, 1)
+	return q.Interface.Depth()
+}
+
+func TestHybridQueueMemoryPath(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_hybrid_queue_memory_path" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	backend := &depthCountingQueue{Interface: New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)}
+	hq := NewHybrid(backend, 10, false, l)
+	NotNil(t, hq)
+	atomic.StoreInt32(&backend.depthCalls, 0)
+
+	// messages kept in memory never ask the backend for its depth
+	for i := 0; i < 5; i++ {
+		Nil(t, hq.Put([]byte{byte(i)}))
+	}
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte{byte(i)}, <-hq.ReadChan())
+	}
+	Equal(t, int32(0), atomic.LoadInt32(&backend.depthCalls))
+
+	// only when asked for
+	Equal(t, int64(0), hq.Depth())
+	Equal(t, int32(1), atomic.LoadInt32(&backend.depthCalls))
+	hq.Close()
+}
@@ -0,0 +1,458 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// frames of the IPC protocol are a big endian uint32 size, followed by a
+// command (or status) byte and its payload. Responses are sent in the order
+// of the commands, which can be pipelined
+const (
+	ipcPut byte = iota + 1 // payload: message, responds ipcOK
+	ipcGet                 // payload: int64 timeout in ns, responds ipcMsg or ipcEmpty
+	ipcAck                 // payload: uint64 id of a message from ipcGet, responds ipcOK
+)
+
+const (
+	ipcOK    byte = iota
+	ipcErr        // payload: error code (see ipcErrs), error message
+	ipcMsg        // payload: uint64 id, message
+	ipcEmpty      // no message arrived before the timeout
+)
+
+// ipcErrs are the sentinel errors sent as the code of their index, 0 is for
+// any other error
+var ipcErrs = []error{nil, ErrClosed, ErrMsgSize, ErrDiskFull, ErrQueueFull, ErrReplicaAcks}
+
+// maxIPCFrameSize caps the size of the frames accepted from the socket
+const maxIPCFrameSize = 1 << 28
+
+// IPCServer serves a queue to local processes over a Unix domain socket
+//
+// messages handed out by get have to be acked, the ones that were not when
+// their connection ends are put back into the queue (i.e. at its end). In
+// between they are taken out of the queue and only held in memory, so they
+// are lost if the server's process dies before they are acked or put back
+type IPCServer struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	nextID uint64
+
+	sync.Mutex
+
+	queue      Interface
+	listener   net.Listener
+	maxUnacked int
+	exitFlag   int32
+
+	logf AppLogFunc
+
+	conns    map[net.Conn]struct{}
+	exitChan chan int
+	waitGrp  sync.WaitGroup
+}
+
+// NewIPCServer serves queue on the Unix domain socket at socketPath,
+// replacing a socket left there by a previous server
+//
+// every connection can hold up to maxUnacked (at least one) messages that
+// were not acked yet, gets fail beyond that. The server owns queue: Close()
+// shuts down the server and then closes queue
+func NewIPCServer(queue Interface, socketPath string, maxUnacked int, logf AppLogFunc) (*IPCServer, error) {
+	return NewIPCServerWithFS(queue, socketPath, maxUnacked, OSFS{}, logf)
+}
+
+// NewIPCServerWithFS is NewIPCServer with the socket left by a previous
+// server looked up and removed through fs
+func NewIPCServerWithFS(queue Interface, socketPath string, maxUnacked int, fs FS, logf AppLogFunc) (*IPCServer, error) {
+	if maxUnacked <= 0 {
+		return nil, fmt.Errorf("invalid number of unacked messages (%d)", maxUnacked)
+	}
+
+	if fileInfo, err := fs.Stat(socketPath); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+		fs.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := IPCServer{
+		queue:      queue,
+		listener:   listener,
+		maxUnacked: maxUnacked,
+		logf:       logf,
+		conns:      make(map[net.Conn]struct{}),
+		exitChan:   make(chan int),
+	}
+
+	s.waitGrp.Add(1)
+	go s.acceptLoop()
+
+	return &s, nil
+}
+
+func (s *IPCServer) acceptLoop() {
+	defer s.waitGrp.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.exitChan:
+			default:
+				s.logf(ERROR, "IPC(%s) failed to accept - %s", s.listener.Addr(), err)
+			}
+			return
+		}
+
+		s.Lock()
+		if s.exitFlag == 1 {
+			s.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.waitGrp.Add(1)
+		s.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// handle executes the commands of a connection in order until it is closed
+func (s *IPCServer) handle(conn net.Conn) {
+	defer s.waitGrp.Done()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	unacked := make(map[uint64][]byte)
+
+	for {
+		cmd, payload, err := readIPCFrame(reader)
+		if err != nil {
+			break
+		}
+
+		status, resp := s.execute(cmd, payload, unacked)
+		err = writeIPCFrame(writer, status, resp)
+		// pipelined commands are answered in one go
+		if err == nil && reader.Buffered() == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+	writer.Flush()
+
+	for _, data := range unacked {
+		err := s.queue.Put(data)
+		if err != nil {
+			s.logf(ERROR, "IPC(%s) failed to put back unacked message - %s", s.listener.Addr(), err)
+		}
+	}
+
+	s.Lock()
+	delete(s.conns, conn)
+	s.Unlock()
+	conn.Close()
+}
+
+func (s *IPCServer) execute(cmd byte, payload []byte, unacked map[uint64][]byte) (byte, []byte) {
+	switch cmd {
+	case ipcPut:
+		err := s.queue.Put(payload)
+		if err != nil {
+			return ipcErr, encodeIPCError(err)
+		}
+		return ipcOK, nil
+	case ipcGet:
+		if len(payload) != 8 {
+			return ipcErr, encodeIPCError(errors.New("invalid get"))
+		}
+		if len(unacked) >= s.maxUnacked {
+			return ipcErr, encodeIPCError(fmt.Errorf("too many unacked messages (%d)", len(unacked)))
+		}
+
+		timer := time.NewTimer(time.Duration(binary.BigEndian.Uint64(payload)))
+		defer timer.Stop()
+
+		select {
+		case data, ok := <-s.queue.ReadChan():
+			if !ok {
+				return ipcErr, encodeIPCError(ErrClosed)
+			}
+			id := atomic.AddUint64(&s.nextID, 1)
+			unacked[id] = data
+			resp := make([]byte, 8+len(data))
+			binary.BigEndian.PutUint64(resp, id)
+			copy(resp[8:], data)
+			return ipcMsg, resp
+		case <-timer.C:
+			return ipcEmpty, nil
+		case <-s.exitChan:
+			return ipcErr, encodeIPCError(ErrClosed)
+		}
+	case ipcAck:
+		if len(payload) != 8 {
+			return ipcErr, encodeIPCError(errors.New("invalid ack"))
+		}
+		id := binary.BigEndian.Uint64(payload)
+		if _, ok := unacked[id]; !ok {
+			return ipcErr, encodeIPCError(fmt.Errorf("unknown message id (%d)", id))
+		}
+		delete(unacked, id)
+		return ipcOK, nil
+	default:
+		return ipcErr, encodeIPCError(fmt.Errorf("invalid command (%d)", cmd))
+	}
+}
+
+// Close stops accepting connections, answers the commands already received,
+// puts back the messages that were not acked and then closes the queue
+func (s *IPCServer) Close() error {
+	s.Lock()
+	if s.exitFlag == 1 {
+		s.Unlock()
+		return nil
+	}
+	s.exitFlag = 1
+
+	close(s.exitChan)
+	s.listener.Close()
+	for conn := range s.conns {
+		// pipelined commands that were already read are still answered
+		conn.SetReadDeadline(time.Now())
+	}
+	s.Unlock()
+
+	s.waitGrp.Wait()
+
+	return s.queue.Close()
+}
+
+func readIPCFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:4])
+	if err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	if size == 0 || size > maxIPCFrameSize {
+		return 0, nil, fmt.Errorf("invalid frame size (%d)", size)
+	}
+
+	frame := make([]byte, size)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	return frame[0], frame[1:], nil
+}
+
+func encodeIPCError(err error) []byte {
+	var code byte
+	for i := 1; i < len(ipcErrs); i++ {
+		if errors.Is(err, ipcErrs[i]) {
+			code = byte(i)
+			break
+		}
+	}
+	return append([]byte{code}, err.Error()...)
+}
+
+// decodeIPCError returns the error of an ipcErr payload, matching the
+// sentinel error of its code
+func decodeIPCError(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("invalid error response")
+	}
+	code := int(payload[0])
+	msg := string(payload[1:])
+	if code > 0 && code < len(ipcErrs) {
+		return &remoteError{msg: msg, err: ipcErrs[code]}
+	}
+	return errors.New(msg)
+}
+
+func writeIPCFrame(w io.Writer, typ byte, payload []byte) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(1+len(payload)))
+	header[4] = typ
+	_, err := w.Write(header[:])
+	if err == nil {
+		_, err = w.Write(payload)
+	}
+	return err
+}
+
+// ipcResponse is a response received by IPCClient
+type ipcResponse struct {
+	status  byte
+	payload []byte
+	err     error
+}
+
+// IPCClient talks to an IPCServer, it is safe for concurrent use: the
+// commands of concurrent calls are pipelined on its connection
+type IPCClient struct {
+	sync.Mutex
+
+	conn   net.Conn
+	writer *bufio.Writer
+	err    error // set once the connection failed
+
+	logf AppLogFunc
+
+	// slots bounds the commands in flight, calls block while it is full
+	slots chan struct{}
+	// the calls waiting for a response, in the order of their commands
+	pending chan chan ipcResponse
+
+	exitSyncChan chan int
+}
+
+// DialIPC connects to the IPCServer listening at socketPath, with up to
+// maxPending commands in flight (at least one)
+func DialIPC(socketPath string, maxPending int, logf AppLogFunc) (*IPCClient, error) {
+	if maxPending <= 0 {
+		return nil, fmt.Errorf("invalid number of pending commands (%d)", maxPending)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := IPCClient{
+		conn:         conn,
+		writer:       bufio.NewWriter(conn),
+		logf:         logf,
+		slots:        make(chan struct{}, maxPending),
+		pending:      make(chan chan ipcResponse, maxPending),
+		exitSyncChan: make(chan int),
+	}
+
+	go c.readLoop()
+
+	return &c, nil
+}
+
+// call sends a command and waits for its response
+func (c *IPCClient) call(cmd byte, payload []byte) ipcResponse {
+	respChan := make(chan ipcResponse, 1)
+
+	// blocks while maxPending commands are in flight
+	c.slots <- struct{}{}
+
+	c.Lock()
+	if c.err != nil {
+		err := c.err
+		c.Unlock()
+		<-c.slots
+		return ipcResponse{err: err}
+	}
+
+	c.pending <- respChan
+
+	err := writeIPCFrame(c.writer, cmd, payload)
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	if err != nil {
+		c.err = err
+		// readLoop fails the pending calls
+		c.conn.Close()
+	}
+	c.Unlock()
+
+	resp := <-respChan
+	if resp.err == nil && resp.status == ipcErr {
+		resp.err = decodeIPCError(resp.payload)
+	}
+	return resp
+}
+
+// readLoop hands the responses to the calls waiting for them
+func (c *IPCClient) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	var err error
+
+	for {
+		var resp ipcResponse
+		resp.status, resp.payload, err = readIPCFrame(reader)
+		if err != nil {
+			break
+		}
+		(<-c.pending) <- resp
+		<-c.slots
+	}
+
+	c.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	err = c.err
+	// no call adds to pending once err is set
+	for len(c.pending) > 0 {
+		(<-c.pending) <- ipcResponse{err: err}
+		<-c.slots
+	}
+	c.Unlock()
+
+	close(c.exitSyncChan)
+}
+
+// Put writes a []byte to the queue
+func (c *IPCClient) Put(data []byte) error {
+	return c.call(ipcPut, data).err
+}
+
+// Get waits for up to timeout for a message, it returns nil data when none
+// arrived in time. The message has to be acked with the returned id
+func (c *IPCClient) Get(timeout time.Duration) (uint64, []byte, error) {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], uint64(timeout))
+
+	resp := c.call(ipcGet, payload[:])
+	if resp.err != nil {
+		return 0, nil, resp.err
+	}
+	if resp.status != ipcMsg {
+		return 0, nil, nil
+	}
+	return binary.BigEndian.Uint64(resp.payload), resp.payload[8:], nil
+}
+
+// Ack confirms that the message with the given id was processed, until then
+// it is put back into the queue if the connection ends. The server only holds
+// it in memory meanwhile, see IPCServer
+func (c *IPCClient) Ack(id uint64) error {
+	var payload [8]byte
+	binary.BigEndian.PutUint64(payload[:], id)
+	return c.call(ipcAck, payload[:]).err
+}
+
+// Close closes the connection, the server puts back the messages that were
+// not acked
+func (c *IPCClient) Close() error {
+	c.Lock()
+	if c.err == nil {
+		c.err = errors.New("closed")
+	}
+	c.Unlock()
+
+	err := c.conn.Close()
+	<-c.exitSyncChan
+	return err
+}
@@ -0,0 +1,115 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIPC(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_ipc" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	socketPath := filepath.Join(tmpDir, "queue.sock")
+	_, err = NewIPCServer(dq, socketPath, 0, l)
+	NotNil(t, err)
+	s, err := NewIPCServer(dq, socketPath, 2, l)
+	Nil(t, err)
+	_, err = DialIPC(socketPath, 0, l)
+	NotNil(t, err)
+
+	// concurrent puts are pipelined on one connection
+	c, err := DialIPC(socketPath, 4, l)
+	Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				Nil(t, c.Put([]byte(strconv.Itoa(i*25+j))))
+			}
+		}(i)
+	}
+	wg.Wait()
+	Equal(t, int64(100), dq.Depth())
+	// the sentinel errors are matched on the client
+	Equal(t, true, errors.Is(c.Put(make([]byte, 2<<10)), ErrMsgSize))
+
+	seen := make(map[string]bool)
+	for i := 0; i < 98; i++ {
+		id, data, err := c.Get(time.Second)
+		Nil(t, err)
+		NotNil(t, data)
+		seen[string(data)] = true
+		Nil(t, c.Ack(id))
+	}
+	NotNil(t, c.Ack(12345))
+
+	// at most 2 unacked messages per connection
+	_, data1, err := c.Get(time.Second)
+	Nil(t, err)
+	_, data2, err := c.Get(time.Second)
+	Nil(t, err)
+	_, _, err = c.Get(time.Second)
+	NotNil(t, err)
+	Nil(t, c.Close())
+	NotNil(t, c.Put([]byte("a")))
+
+	// the unacked messages are delivered again to another connection
+	c, err = DialIPC(socketPath, 4, l)
+	Nil(t, err)
+	redelivered := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		id, data, err := c.Get(time.Second)
+		Nil(t, err)
+		redelivered[string(data)] = true
+		Nil(t, c.Ack(id))
+	}
+	Equal(t, map[string]bool{string(data1): true, string(data2): true}, redelivered)
+	seen[string(data1)] = true
+	seen[string(data2)] = true
+	Equal(t, 100, len(seen))
+
+	// times out while the queue is empty
+	start := time.Now()
+	_, data, err := c.Get(50 * time.Millisecond)
+	Nil(t, err)
+	Nil(t, data)
+	Equal(t, true, time.Since(start) >= 50*time.Millisecond)
+
+	// Close answers the waiting get and puts back unacked messages
+	Nil(t, c.Put([]byte("b")))
+	_, data, err = c.Get(time.Second)
+	Nil(t, err)
+	Equal(t, []byte("b"), data)
+	getErrChan := make(chan error)
+	go func() {
+		_, _, err := c.Get(10 * time.Second)
+		getErrChan <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	Nil(t, s.Close())
+	Equal(t, true, errors.Is(<-getErrChan, ErrClosed))
+	NotNil(t, c.Put([]byte("c")))
+	c.Close()
+	Nil(t, s.Close())
+
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("b"), <-dq.ReadChan())
+	dq.Close()
+}
@@ -0,0 +1,72 @@
+package diskqueue
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+// Lifecycle is implemented by queues that tell when they shut down and that
+// can remove their files
+type Lifecycle interface {
+	Done() <-chan struct{}
+	Destroy() error
+}
+
+// the states of a diskQueue, which only moves forward through them
+const (
+	stateOpen      = iota
+	stateClosed    // by Close() or Delete(), its files are left behind
+	stateDestroyed // by Destroy(), its files were removed
+)
+
+// Done returns a channel that is closed once the queue was closed and its
+// metadata persisted, if it was closed by Close()
+//
+// ReadChan(), PeekChan() and MessageChan() are closed along with it
+func (d *diskQueue) Done() <-chan struct{} {
+	return d.doneChan
+}
+
+// Destroy closes the queue without persisting metadata, unless it was
+// already closed, and removes its data, bad and metadata files along with
+// those of its features (e.g. delayed messages)
+func (d *diskQueue) Destroy() error {
+	d.Delete()
+	// a Close() running along may still be persisting metadata
+	<-d.doneChan
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.state == stateDestroyed {
+		return nil
+	}
+	d.state = stateDestroyed
+
+	d.logf(INFO, "DISKQUEUE(%s): destroying", d.name)
+
+	return d.removeFiles()
+}
+
+// removeFiles removes every file of the queue found in dataPath
+func (d *diskQueue) removeFiles() error {
+	fileInfos, err := d.fs.ReadDir(d.dataPath)
+	if err != nil {
+		return err
+	}
+
+	prefix := d.name + ".diskqueue."
+	for _, fileInfo := range fileInfos {
+		if !strings.HasPrefix(fileInfo.Name(), prefix) {
+			continue
+		}
+		innerErr := d.fs.Remove(path.Join(d.dataPath, fileInfo.Name()))
+		if innerErr != nil && !os.IsNotExist(innerErr) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to remove %s - %s", d.name, fileInfo.Name(), innerErr)
+			err = innerErr
+		}
+	}
+
+	return err
+}
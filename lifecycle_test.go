@@ -0,0 +1,188 @@
+package diskqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueLifecycle(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_lifecycle" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 4, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	err = dq.Put([]byte("abc"))
+	Equal(t, true, errors.Is(err, ErrMsgSize))
+	err = dq.Put(make([]byte, 2<<10))
+	Equal(t, true, errors.Is(err, ErrMsgSize))
+
+	readChan := make(chan bool)
+	go func() {
+		_, ok := <-dq.ReadChan()
+		readChan <- ok
+	}()
+	select {
+	case <-dq.(Lifecycle).Done():
+		t.Fatal("Done() was closed before the queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	Nil(t, dq.Close())
+	// readers are told that the queue shut down
+	Equal(t, false, <-readChan)
+	_, ok := <-dq.PeekChan()
+	Equal(t, false, ok)
+	<-dq.(Lifecycle).Done()
+
+	// shutting down again does nothing
+	Nil(t, dq.Close())
+	Nil(t, dq.Delete())
+	Equal(t, ErrClosed, dq.Put([]byte("abcd")))
+	Equal(t, ErrClosed, dq.Empty())
+	_, err = dq.(Peeker).Peek(context.Background())
+	Equal(t, ErrClosed, err)
+}
+
+func TestDiskQueueDestroy(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_destroy" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	other := New(dqName+"_other", tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Nil(t, other.Put([]byte("kept")))
+	other.Close()
+
+	dq := New(dqName, tmpDir, 20, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("later"), time.Now().Add(time.Hour)))
+	Nil(t, ioutil.WriteFile(dq.(*diskQueue).fileName(100)+".bad", []byte("bad"), 0600))
+	Nil(t, dq.Close())
+
+	matches, err := filepath.Glob(filepath.Join(tmpDir, dqName+".diskqueue.*"))
+	Nil(t, err)
+	Equal(t, true, len(matches) > 3)
+
+	// the files of a closed queue can be removed as well
+	Nil(t, dq.(Lifecycle).Destroy())
+	Nil(t, dq.(Lifecycle).Destroy())
+	matches, err = filepath.Glob(filepath.Join(tmpDir, dqName+".diskqueue.*"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+
+	other = New(dqName+"_other", tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, []byte("kept"), <-other.ReadChan())
+	Nil(t, other.(Lifecycle).Destroy())
+	matches, err = filepath.Glob(filepath.Join(tmpDir, "*"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+}
+
+func TestWrapperLifecycle(t *testing.T) {
+	l := NewTestLogger(t)
+	name := "test_wrapper_lifecycle" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+	}
+
+	pq, err := NewPriority(name+"_p", tmpDir, 2, nil, opts, l)
+	Nil(t, err)
+	sq, err := NewSharded(name+"_s", tmpDir, 2, opts, l)
+	Nil(t, err)
+	hq := NewHybrid(NewWithOptions(name+"_h", tmpDir, opts, l), 1, false, l)
+
+	served := NewWithOptions(name+"_c", tmpDir, opts, l)
+	defer served.Close()
+	srv := httptest.NewServer(NewHTTPHandler(served, 1<<10, l))
+	defer srv.Close()
+	hc := NewHTTPClient(srv.URL+"/queues/"+name+"_c", nil, 100*time.Millisecond, l)
+
+	type lifecycleQueue interface {
+		ReadChan() <-chan []byte
+		Close() error
+		Lifecycle
+	}
+	for _, q := range []lifecycleQueue{pq, sq, hq.(lifecycleQueue), hc.(lifecycleQueue)} {
+		readChan := make(chan bool)
+		go func() {
+			_, ok := <-q.ReadChan()
+			readChan <- ok
+		}()
+		select {
+		case <-q.Done():
+			t.Fatal("Done() was closed before the queue")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		Nil(t, q.Close())
+		// readers are told that the queue shut down
+		Equal(t, false, <-readChan)
+		<-q.Done()
+		Nil(t, q.Close())
+		Nil(t, q.Destroy())
+	}
+	for _, q := range []Interface{hq, hc} {
+		_, ok := <-q.PeekChan()
+		Equal(t, false, ok)
+	}
+
+	// typed queues delegate to the queue they wrap when it is a Lifecycle,
+	// and only close the other ones
+	tq := NewTyped(NewWithOptions(name+"_t", tmpDir, opts, l), JSONCodec{}, nil, l)
+	plain := NewWithOptions(name+"_u", tmpDir, opts, l)
+	ptq := NewTyped(struct{ Interface }{plain}, JSONCodec{}, nil, l)
+	for _, q := range []*TypedQueue{tq, ptq} {
+		receiveErrChan := make(chan error)
+		go func() {
+			var v string
+			receiveErrChan <- q.Receive(&v)
+		}()
+		select {
+		case <-q.Done():
+			t.Fatal("Done() was closed before the queue")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		Nil(t, q.Close())
+		Equal(t, ErrClosed, <-receiveErrChan)
+		<-q.Done()
+		Nil(t, q.Destroy())
+	}
+	matches, err := filepath.Glob(filepath.Join(tmpDir, name+"_u*"))
+	Nil(t, err)
+	Equal(t, true, len(matches) > 0)
+	Nil(t, plain.(Lifecycle).Destroy())
+
+	// the files of the queues are removed, the served queue is not touched
+	matches, err = filepath.Glob(filepath.Join(tmpDir, name+"_[pshtu]*"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+	Nil(t, served.Put([]byte("served")))
+}
@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package diskqueue
+
+import (
+	"errors"
+)
+
+// mmapFile always fails on this platform so that reads fall back to bufio
+func mmapFile(f File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
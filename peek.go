@@ -0,0 +1,69 @@
+package diskqueue
+
+import (
+	"context"
+)
+
+// Peeker is implemented by queues that can return pending messages without
+// consuming them, rather than through PeekChan()
+type Peeker interface {
+	Peek(ctx context.Context) ([]byte, error)
+	PeekN(ctx context.Context, n int) ([][]byte, error)
+}
+
+// head is the first pending message, offered on headChan along with its
+// position so that it is consumed by take() only if it still is the first
+type head struct {
+	pos  Position
+	data []byte
+}
+
+// take consumes the message at pos, which was received from headChan. It
+// does nothing if the message was expired or evicted in the meantime, rather
+// than consuming the one that followed it
+func (d *diskQueue) take(pos Position) error {
+	return d.request(func() { d.takeChan <- pos }, d.takeResponseChan)
+}
+
+// Peek returns the first pending message without consuming it, waiting for
+// one until ctx is done. Its buffer is never recycled, even with PoolBuffers
+func (d *diskQueue) Peek(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-d.peekChan:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.exitChan:
+		return nil, ErrClosed
+	}
+}
+
+// PeekN returns up to the first n pending messages without consuming them,
+// waiting for the first one until ctx is done. Fewer are returned when
+// fewer are pending, and messages that already expired are left out
+func (d *diskQueue) PeekN(ctx context.Context, n int) ([][]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	_, err := d.Peek(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([][]byte, 0, n)
+	err = d.scan(func(pos Position, f frame) bool {
+		// f may be backed by a pooled buffer
+		msg := make([]byte, len(f.data))
+		copy(msg, f.data)
+		msgs = append(msgs, msg)
+		return len(msgs) < n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
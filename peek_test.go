@@ -0,0 +1,94 @@
+package diskqueue
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueuePeekContext(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_peek_context" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	// gives up on an empty queue once ctx is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	_, err = dq.(Peeker).Peek(ctx)
+	Equal(t, context.DeadlineExceeded, err)
+	_, err = dq.(Peeker).PeekN(ctx, 5)
+	Equal(t, context.DeadlineExceeded, err)
+	cancel()
+
+	// or waits for a message
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		dq.Put([]byte("a"))
+	}()
+	data, err := dq.(Peeker).Peek(context.Background())
+	Nil(t, err)
+	Equal(t, []byte("a"), data)
+	Equal(t, int64(1), dq.Depth())
+
+	dq.Close()
+	_, err = dq.(Peeker).Peek(context.Background())
+	NotNil(t, err)
+}
+
+func TestDiskQueuePeekN(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_peek_n" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	for i := 0; i < 50; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	for i := 0; i < 15; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	dq.Close()
+
+	// starts from the persisted read position and spans several files
+	dq = New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	msgs, err := dq.(Peeker).PeekN(context.Background(), 20)
+	Nil(t, err)
+	Equal(t, 20, len(msgs))
+	for i, msg := range msgs {
+		Equal(t, []byte(strconv.Itoa(i+15)), msg)
+	}
+	Equal(t, int64(35), dq.Depth())
+
+	msgs, err = dq.(Peeker).PeekN(context.Background(), 100)
+	Nil(t, err)
+	Equal(t, 35, len(msgs))
+	Equal(t, []byte("49"), msgs[34])
+	msgs, err = dq.(Peeker).PeekN(context.Background(), 0)
+	Nil(t, err)
+	Equal(t, 0, len(msgs))
+
+	// expired messages are left out
+	Nil(t, dq.(TTLPutter).PutWithTTL([]byte("expired"), time.Nanosecond))
+	Nil(t, dq.Put([]byte("50")))
+	time.Sleep(time.Millisecond)
+	msgs, err = dq.(Peeker).PeekN(context.Background(), 100)
+	Nil(t, err)
+	Equal(t, 36, len(msgs))
+	Equal(t, []byte("50"), msgs[35])
+	Equal(t, []byte("15"), <-dq.ReadChan())
+	dq.Close()
+}
@@ -0,0 +1,96 @@
+package diskqueue
+
+import (
+	"io"
+	"os"
+)
+
+// preallocate reserves maxBytesPerFile for the file writeOne opened
+//
+// it only saves fragmentation, so a failure is not fatal and the file is
+// left to grow when the reservation does not fit within the disk space limit
+// rather than evicting messages to make room for it
+func (d *diskQueue) preallocate(f File) {
+	reserve := d.maxBytesPerFile - d.writePos
+	if reserve <= d.writeFileReserved {
+		// reserved before the file was reopened
+		return
+	}
+
+	increase := reserve - d.writeFileReserved
+	if d.enableDiskLimitation && d.totalDiskSpaceUsed+increase > d.maxBytesDiskSpace {
+		d.logf(WARN, "DISKQUEUE(%s) not preallocating %s, it does not fit within the disk space limit",
+			d.name, f.Name())
+		return
+	}
+
+	err := fallocate(f, d.maxBytesPerFile)
+	if err != nil {
+		d.logf(WARN, "DISKQUEUE(%s) failed to preallocate %s - %s", d.name, f.Name(), err)
+		return
+	}
+
+	d.writeFileReserved = reserve
+	if d.enableDiskLimitation {
+		d.totalDiskSpaceUsed += increase
+	}
+}
+
+// releaseReserved forgets the bytes reserved past writePos once writeFile was
+// truncated to, or rolled at, the end of its data
+func (d *diskQueue) releaseReserved() {
+	if d.enableDiskLimitation {
+		d.totalDiskSpaceUsed -= d.writeFileReserved
+	}
+	d.writeFileReserved = 0
+}
+
+// trimWriteFile truncates the file being written to at the write position,
+// dropping what a crash may have left past it: its preallocated tail or part
+// of a message whose write was never persisted in the metadata
+//
+// complete files are trimmed before the message that completes them is
+// written, so they never have such a tail
+func (d *diskQueue) trimWriteFile() error {
+	fileName := d.fileName(d.writeFileNum)
+	stat, err := d.fs.Stat(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if stat.Size() <= d.writePos {
+		return nil
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s) truncating %s from %d to the write position %d",
+		d.name, fileName, stat.Size(), d.writePos)
+	return d.fs.Truncate(fileName, d.writePos)
+}
+
+// writtenReader reads the preallocated file that is being written to, up to
+// the data written so far rather than into its zero filled tail
+type writtenReader struct {
+	f     File
+	pos   int64
+	limit func() int64 // where the written data currently ends
+}
+
+func (w *writtenReader) Read(p []byte) (int, error) {
+	remaining := w.limit() - w.pos
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := w.f.ReadAt(p, w.pos)
+	w.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,240 @@
+package diskqueue
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueuePreallocate(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_preallocate" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		for _, readAhead := range []int{0, 4} {
+			opts := Options{
+				MaxBytesDiskSpace: diskLimit,
+				MaxBytesPerFile:   1000,
+				MinMsgSize:        0,
+				MaxMsgSize:        1 << 10,
+				SyncEvery:         2500,
+				SyncTimeout:       2 * time.Second,
+				ReadAhead:         readAhead,
+				Preallocate:       true,
+			}
+			name := dqName + strconv.Itoa(int(diskLimit)) + strconv.Itoa(readAhead)
+			dq := NewWithOptions(name, tmpDir, opts, l)
+			NotNil(t, dq)
+
+			msg := func(i int) []byte {
+				// every 4th message is empty
+				return bytes.Repeat([]byte{byte(i)}, (i%4)*50)
+			}
+
+			// reads do not run into the preallocated tail of the file
+			// that is written to
+			for i := 0; i < 5; i++ {
+				Nil(t, dq.Put(msg(i)))
+				Equal(t, msg(i), <-dq.ReadChan())
+			}
+			Equal(t, int64(0), dq.Depth())
+			if runtime.GOOS == "linux" {
+				stat, err := os.Stat(dq.(*diskQueue).fileName(0))
+				Nil(t, err)
+				Equal(t, int64(1000), stat.Size())
+			}
+
+			for i := 5; i < 40; i++ {
+				Nil(t, dq.Put(msg(i)))
+			}
+			dq.Close()
+
+			// rolled files are trimmed to their data
+			for i := int64(0); i < dq.(*diskQueue).writeFileNum; i++ {
+				f, err := os.Open(dq.(*diskQueue).fileName(i))
+				Nil(t, err)
+				stat, err := f.Stat()
+				Nil(t, err)
+				Equal(t, true, stat.Size() >= 1000)
+				Equal(t, true, stat.Size() < 1000+4+3*50+numFileMsgBytes)
+				f.Close()
+			}
+
+			dq = NewWithOptions(name, tmpDir, opts, l)
+			Equal(t, int64(35), dq.Depth())
+			for i := 5; i < 40; i++ {
+				Equal(t, msg(i), <-dq.ReadChan())
+			}
+			Equal(t, int64(0), dq.Depth())
+			Equal(t, int64(0), numberOfBadFiles(name, tmpDir))
+			dq.Close()
+		}
+	}
+}
+
+func TestDiskQueuePreallocateCrash(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_preallocate_crash" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		for _, preallocate := range []bool{true, false} {
+			opts := Options{
+				MaxBytesDiskSpace: diskLimit,
+				MaxBytesPerFile:   500,
+				MinMsgSize:        0,
+				MaxMsgSize:        1 << 10,
+				SyncEvery:         2500,
+				SyncTimeout:       2 * time.Second,
+				Preallocate:       true,
+			}
+			name := dqName + strconv.Itoa(int(diskLimit)) + strconv.FormatBool(preallocate)
+			dq := NewWithOptions(name, tmpDir, opts, l)
+			NotNil(t, dq)
+
+			msg := make([]byte, 96) // 100 bytes per message, 5 messages per file
+			Nil(t, dq.Put(nil))
+			for i := 0; i < 9; i++ {
+				Nil(t, dq.Put(msg))
+			}
+			dq.Close()
+
+			// the queue crashed with the write file preallocated further than
+			// usual and part of a message written past the write position
+			fileName := dq.(*diskQueue).fileName(1)
+			writePos := dq.(*diskQueue).writePos
+			Equal(t, int64(400), writePos)
+			Nil(t, os.Truncate(fileName, 2000))
+			f, err := os.OpenFile(fileName, os.O_RDWR, 0600)
+			Nil(t, err)
+			_, err = f.WriteAt([]byte{0, 0, 0, 96, 1, 2, 3}, writePos)
+			Nil(t, err)
+			f.Close()
+
+			// whether it is preallocated again or not, the write file is
+			// trimmed to its data
+			opts.Preallocate = preallocate
+			dq = NewWithOptions(name, tmpDir, opts, l)
+			stat, err := os.Stat(fileName)
+			Nil(t, err)
+			Equal(t, writePos, stat.Size())
+
+			for i := 0; i < 6; i++ {
+				Nil(t, dq.Put(msg))
+			}
+			Equal(t, int64(16), dq.Depth())
+			Equal(t, []byte{}, <-dq.ReadChan())
+			for i := 0; i < 15; i++ {
+				Equal(t, msg, <-dq.ReadChan())
+			}
+			Equal(t, int64(0), dq.Depth())
+			Equal(t, int64(0), numberOfBadFiles(name, tmpDir))
+			dq.Close()
+		}
+	}
+}
+
+func TestDiskQueuePreallocateEmptyMessages(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_preallocate_empty" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		opts := Options{
+			MaxBytesDiskSpace: diskLimit,
+			MaxBytesPerFile:   100,
+			MinMsgSize:        0,
+			MaxMsgSize:        1 << 10,
+			SyncEvery:         2500,
+			SyncTimeout:       2 * time.Second,
+		}
+		name := dqName + strconv.Itoa(int(diskLimit))
+		dq := NewWithOptions(name, tmpDir, opts, l)
+		NotNil(t, dq)
+
+		// plain empty messages, i.e. length prefixes of 0, in complete files
+		// and in the file being written to
+		for i := 0; i < 60; i++ {
+			Nil(t, dq.Put(nil))
+		}
+		Equal(t, true, dq.(*diskQueue).writeFileNum > 0)
+		Equal(t, true, dq.(*diskQueue).writePos > 0)
+		dq.Close()
+
+		opts.Preallocate = true
+		dq = NewWithOptions(name, tmpDir, opts, l)
+		for i := 0; i < 30; i++ {
+			Nil(t, dq.Put(nil))
+		}
+		Equal(t, int64(90), dq.Depth())
+		for i := 0; i < 90; i++ {
+			Equal(t, []byte{}, <-dq.ReadChan())
+		}
+		Equal(t, int64(0), dq.Depth())
+		Equal(t, int64(0), numberOfBadFiles(name, tmpDir))
+		dq.Close()
+	}
+}
+
+func TestDiskQueuePreallocateDiskUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("files are only preallocated on linux")
+	}
+
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_preallocate_usage" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesDiskSpace: 1 << 20,
+		MaxBytesPerFile:   1000,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		Preallocate:       true,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	// the write file is accounted for with its preallocated tail
+	msg := make([]byte, 96)
+	Nil(t, dq.Put(msg))
+	Equal(t, int64(maxMetaDataFileSize+1000), dq.(*diskQueue).totalDiskSpaceUsed)
+	for i := 0; i < 8; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	Equal(t, int64(maxMetaDataFileSize+1000), dq.(*diskQueue).totalDiskSpaceUsed)
+
+	// and what is left of it is freed when the file is rolled
+	Nil(t, dq.Put(msg))
+	Equal(t, int64(1), dq.(*diskQueue).writeFileNum)
+	Equal(t, int64(maxMetaDataFileSize+1000+numFileMsgBytes), dq.(*diskQueue).totalDiskSpaceUsed)
+	Nil(t, dq.Put(msg))
+	Equal(t, int64(maxMetaDataFileSize+1000+numFileMsgBytes+1000), dq.(*diskQueue).totalDiskSpaceUsed)
+	dq.Close()
+
+	// at startup, it is taken from the size of the files
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Nil(t, dq.Put(msg))
+	Equal(t, int64(maxMetaDataFileSize+1000+numFileMsgBytes+1000), dq.(*diskQueue).totalDiskSpaceUsed)
+	dq.Close()
+}
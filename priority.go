@@ -0,0 +1,423 @@
+package diskqueue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PriorityQueue manages several diskQueues, one per priority level, that are
+// read through a single channel and share one disk space budget
+//
+// level 0 has the highest priority. By default a level is only read once every
+// higher priority level is empty, weights can be given to guarantee lower
+// priority levels a share of the reads
+type PriorityQueue struct {
+	sync.RWMutex
+
+	name              string
+	levels            []*diskQueue
+	weights           []int
+	credits           []int
+	maxBytesDiskSpace int64
+	syncTimeout       time.Duration
+	exitFlag          int32
+
+	logf AppLogFunc
+
+	// exposed via ReadChan()
+	readChan chan []byte
+
+	// internal channels
+	putNotifyChan     chan int
+	depthChan         chan int
+	depthResponseChan chan int64
+	emptyChan         chan int
+	emptyResponseChan chan error
+	exitChan          chan int
+	exitSyncChan      chan int
+
+	// exposed via Done()
+	doneChan chan struct{}
+}
+
+// NewPriority instantiates a PriorityQueue with numLevels levels stored in
+// dataPath as the diskQueues <name>.p0, <name>.p1, ...
+//
+// opts.MaxBytesDiskSpace is the budget shared by every level, once it is
+// reached the oldest data of the lowest priority level is evicted first.
+// Only the size and sync parameters of opts are used.
+//
+// weights is either nil for strict priority or holds one positive weight per
+// level: when every level has data, level i is read weights[i] times for
+// every sum(weights) reads
+func NewPriority(name string, dataPath string, numLevels int, weights []int,
+	opts Options, logf AppLogFunc) (*PriorityQueue, error) {
+
+	if numLevels <= 0 {
+		return nil, fmt.Errorf("invalid number of priority levels (%d)", numLevels)
+	}
+
+	if weights != nil {
+		if len(weights) != numLevels {
+			return nil, fmt.Errorf("got %d weights for %d priority levels", len(weights), numLevels)
+		}
+		for _, weight := range weights {
+			if weight <= 0 {
+				return nil, fmt.Errorf("invalid priority weight (%d)", weight)
+			}
+		}
+	}
+
+	// every level needs room for its metadata file, on top of the one data file
+	// with max size that diskQueue itself checks for
+	if opts.MaxBytesDiskSpace > 0 &&
+		opts.MaxBytesDiskSpace <= int64(numLevels)*maxMetaDataFileSize+opts.MaxBytesPerFile {
+		return nil, fmt.Errorf(
+			"disk size limit too small(%d): not enough space for %d MetaData files (size=%d) and at least one data file with max size (maxBytesPerFile=%d)",
+			opts.MaxBytesDiskSpace, numLevels, maxMetaDataFileSize, opts.MaxBytesPerFile)
+	}
+
+	pq := PriorityQueue{
+		name:              name,
+		weights:           weights,
+		credits:           make([]int, numLevels),
+		maxBytesDiskSpace: opts.MaxBytesDiskSpace,
+		syncTimeout:       opts.SyncTimeout,
+		logf:              logf,
+		readChan:          make(chan []byte),
+		doneChan:          make(chan struct{}),
+		putNotifyChan:     make(chan int, 1),
+		depthChan:         make(chan int),
+		depthResponseChan: make(chan int64),
+		emptyChan:         make(chan int),
+		emptyResponseChan: make(chan error),
+		exitChan:          make(chan int),
+		exitSyncChan:      make(chan int),
+	}
+
+	// the levels enforce the shared budget as a whole through evictions,
+	// their own limit only keeps the per file message counts needed for that
+	levelOpts := Options{
+		MaxBytesDiskSpace: opts.MaxBytesDiskSpace,
+		MaxBytesPerFile:   opts.MaxBytesPerFile,
+		MinMsgSize:        opts.MinMsgSize,
+		MaxMsgSize:        opts.MaxMsgSize,
+		SyncEvery:         opts.SyncEvery,
+		SyncTimeout:       opts.SyncTimeout,
+	}
+
+	for i := 0; i < numLevels; i++ {
+		level := NewWithOptions(pq.levelName(i), dataPath, levelOpts, logf)
+		if level == nil {
+			for _, dq := range pq.levels {
+				dq.Close()
+			}
+			return nil, fmt.Errorf("failed to create priority level %d", i)
+		}
+		pq.levels = append(pq.levels, level.(*diskQueue))
+	}
+
+	go pq.dispatchLoop()
+
+	return &pq, nil
+}
+
+func (pq *PriorityQueue) levelName(level int) string {
+	return fmt.Sprintf("%s.p%d", pq.name, level)
+}
+
+// ReadChan returns the receive-only []byte channel for reading data
+// from every level, highest priority first. It is closed by Close() and
+// Delete()
+func (pq *PriorityQueue) ReadChan() <-chan []byte {
+	return pq.readChan
+}
+
+// Put writes a []byte to the given priority level
+func (pq *PriorityQueue) Put(prio int, data []byte) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	if pq.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	if prio < 0 || prio >= len(pq.levels) {
+		return fmt.Errorf("invalid priority (%d)", prio)
+	}
+
+	if pq.maxBytesDiskSpace > 0 {
+		err := pq.freeDiskSpace(int64(4+len(data)) + numFileMsgBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := pq.levels[prio].Put(data)
+	if err != nil {
+		return err
+	}
+
+	// let the dispatcher reconsider what it is offering
+	select {
+	case pq.putNotifyChan <- 1:
+	default:
+	}
+
+	return nil
+}
+
+// freeDiskSpace evicts the oldest files of the lowest priority levels until
+// expectedBytesIncrease fits within the shared budget
+func (pq *PriorityQueue) freeDiskSpace(expectedBytesIncrease int64) error {
+	if expectedBytesIncrease > pq.maxBytesDiskSpace {
+		return fmt.Errorf("%w: message size(%d) surpasses disk size limit(%d)",
+			ErrMsgSize, expectedBytesIncrease, pq.maxBytesDiskSpace)
+	}
+
+	level := len(pq.levels) - 1
+	for level >= 0 {
+		var totalDiskSpaceUsed int64
+		for _, dq := range pq.levels {
+			totalDiskSpaceUsed += <-dq.usageChan
+		}
+
+		if totalDiskSpaceUsed+expectedBytesIncrease <= pq.maxBytesDiskSpace {
+			return nil
+		}
+
+		pq.levels[level].evictChan <- 1
+		err := <-pq.levels[level].evictResponseChan
+		if err != nil {
+			// nothing left to evict at this level
+			level--
+			continue
+		}
+
+		pq.logf(INFO, "PRIORITYQUEUE(%s) evicted a file of level %d to free up disk space", pq.name, level)
+	}
+
+	return fmt.Errorf("%w: could not make space for expectedBytesIncrease = %d, with maxBytesDiskSpace = %d",
+		ErrDiskFull, expectedBytesIncrease, pq.maxBytesDiskSpace)
+}
+
+// Depth returns the depth of every level combined
+func (pq *PriorityQueue) Depth() int64 {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	if pq.exitFlag == 1 {
+		return pq.levelsDepth()
+	}
+
+	// asking dispatchLoop leaves out messages that were received but
+	// not yet read from their level
+	pq.depthChan <- 1
+	return <-pq.depthResponseChan
+}
+
+func (pq *PriorityQueue) levelsDepth() int64 {
+	var depth int64
+	for _, dq := range pq.levels {
+		depth += dq.Depth()
+	}
+	return depth
+}
+
+// LevelDepth returns the depth of a single priority level
+func (pq *PriorityQueue) LevelDepth(prio int) int64 {
+	return pq.levels[prio].Depth()
+}
+
+// Empty destructively clears out any pending data in every level
+func (pq *PriorityQueue) Empty() error {
+	pq.RLock()
+	defer pq.RUnlock()
+
+	if pq.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	pq.emptyChan <- 1
+	return <-pq.emptyResponseChan
+}
+
+// Close cleans up every level and persists their metadata
+func (pq *PriorityQueue) Close() error {
+	return pq.exit(false)
+}
+
+// Delete cleans up every level without persisting their metadata
+func (pq *PriorityQueue) Delete() error {
+	return pq.exit(true)
+}
+
+func (pq *PriorityQueue) exit(deleted bool) error {
+	pq.Lock()
+	defer pq.Unlock()
+
+	if pq.exitFlag == 1 {
+		return nil
+	}
+	pq.exitFlag = 1
+
+	close(pq.exitChan)
+	// ensure that dispatchLoop has exited
+	<-pq.exitSyncChan
+
+	var err error
+	for _, dq := range pq.levels {
+		var innerErr error
+		if deleted {
+			innerErr = dq.Delete()
+		} else {
+			innerErr = dq.Close()
+		}
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	close(pq.doneChan)
+
+	return err
+}
+
+// Done returns a channel that is closed once every level was closed, along
+// with ReadChan()
+func (pq *PriorityQueue) Done() <-chan struct{} {
+	return pq.doneChan
+}
+
+// Destroy deletes the queue, unless it was already closed, and removes the
+// files of every level
+func (pq *PriorityQueue) Destroy() error {
+	pq.Delete()
+	// a Close() running along may still be closing the levels
+	<-pq.doneChan
+
+	var err error
+	for _, dq := range pq.levels {
+		innerErr := dq.Destroy()
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	return err
+}
+
+// nextLevel returns the level to read from next, or -1 when all are empty
+func (pq *PriorityQueue) nextLevel() int {
+	ready := -1
+	for i, dq := range pq.levels {
+		if dq.Depth() == 0 {
+			continue
+		}
+		if pq.weights == nil || pq.credits[i] > 0 {
+			return i
+		}
+		if ready < 0 {
+			ready = i
+		}
+	}
+
+	if ready >= 0 {
+		// every level with data spent its share, start a new round
+		copy(pq.credits, pq.weights)
+	}
+
+	return ready
+}
+
+// dispatchLoop feeds ReadChan() from the levels
+//
+// it peeks at the head of the chosen level and only takes it (i.e. removes it
+// from disk) once a consumer received it, so that a message that has been
+// offered can still be replaced by a higher priority one. It is taken by its
+// position, so a head that was evicted in the meantime is not mistaken for
+// the message that followed it
+func (pq *PriorityQueue) dispatchLoop() {
+	var level int
+	var h head
+
+	recheckTicker := time.NewTicker(pq.syncTimeout)
+
+	for {
+		level = pq.nextLevel()
+		if level < 0 {
+			select {
+			case <-pq.putNotifyChan:
+			case <-recheckTicker.C:
+			case <-pq.depthChan:
+				pq.depthResponseChan <- pq.levelsDepth()
+			case <-pq.emptyChan:
+				pq.emptyResponseChan <- pq.emptyLevels()
+			case <-pq.exitChan:
+				goto exit
+			}
+			continue
+		}
+
+		// the level can still run dry, e.g. when a corrupt file is skipped
+		select {
+		case h = <-pq.levels[level].headChan:
+		case <-recheckTicker.C:
+			continue
+		case <-pq.depthChan:
+			pq.depthResponseChan <- pq.levelsDepth()
+			continue
+		case <-pq.emptyChan:
+			pq.emptyResponseChan <- pq.emptyLevels()
+			continue
+		case <-pq.exitChan:
+			goto exit
+		}
+
+		// a put that raced with the peek may have brought a higher priority message
+		select {
+		case <-pq.putNotifyChan:
+			continue
+		default:
+		}
+
+		select {
+		case pq.readChan <- h.data:
+			err := pq.levels[level].take(h.pos)
+			if err != nil {
+				pq.logf(ERROR, "PRIORITYQUEUE(%s) failed to consume message of level %d - %s", pq.name, level, err)
+			}
+			if pq.weights != nil {
+				pq.credits[level]--
+			}
+		case <-pq.putNotifyChan:
+		case <-pq.depthChan:
+			pq.depthResponseChan <- pq.levelsDepth()
+		case <-pq.emptyChan:
+			pq.emptyResponseChan <- pq.emptyLevels()
+		case <-pq.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	pq.logf(INFO, "PRIORITYQUEUE(%s): closing ... dispatchLoop", pq.name)
+	recheckTicker.Stop()
+	// tells readers that nothing is coming anymore
+	close(pq.readChan)
+	pq.exitSyncChan <- 1
+}
+
+func (pq *PriorityQueue) emptyLevels() error {
+	var err error
+
+	pq.logf(INFO, "PRIORITYQUEUE(%s): emptying", pq.name)
+
+	for _, dq := range pq.levels {
+		innerErr := dq.Empty()
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,190 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	pqName := "test_priority_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+	}
+	pq, err := NewPriority(pqName, tmpDir, 3, nil, opts, l)
+	Nil(t, err)
+	NotNil(t, pq)
+
+	for i := 0; i < 10; i++ {
+		Nil(t, pq.Put(2, []byte{2, byte(i)}))
+	}
+	for i := 0; i < 10; i++ {
+		Nil(t, pq.Put(1, []byte{1, byte(i)}))
+	}
+	for i := 0; i < 10; i++ {
+		Nil(t, pq.Put(0, []byte{0, byte(i)}))
+	}
+	NotNil(t, pq.Put(3, []byte{3}))
+	Equal(t, int64(30), pq.Depth())
+	Equal(t, int64(10), pq.LevelDepth(1))
+
+	for prio := 0; prio < 3; prio++ {
+		for i := 0; i < 10; i++ {
+			Equal(t, []byte{byte(prio), byte(i)}, <-pq.ReadChan())
+		}
+	}
+	Equal(t, int64(0), pq.Depth())
+
+	// a higher priority message replaces the one already offered
+	Nil(t, pq.Put(2, []byte{2}))
+	time.Sleep(10 * time.Millisecond)
+	Nil(t, pq.Put(0, []byte{0}))
+	time.Sleep(10 * time.Millisecond)
+	Equal(t, []byte{0}, <-pq.ReadChan())
+	Equal(t, []byte{2}, <-pq.ReadChan())
+
+	// levels persist across restarts
+	Nil(t, pq.Put(1, []byte{1}))
+	Nil(t, pq.Close())
+	pq, err = NewPriority(pqName, tmpDir, 3, nil, opts, l)
+	Nil(t, err)
+	Equal(t, int64(1), pq.LevelDepth(1))
+	Equal(t, []byte{1}, <-pq.ReadChan())
+
+	Nil(t, pq.Put(2, []byte{2}))
+	Nil(t, pq.Empty())
+	Equal(t, int64(0), pq.Depth())
+	pq.Close()
+}
+
+func TestPriorityQueueWeights(t *testing.T) {
+	l := NewTestLogger(t)
+	pqName := "test_priority_queue_weights" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pq, err := NewPriority(pqName, tmpDir, 2, []int{3, 1}, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+	}, l)
+	Nil(t, err)
+	defer pq.Close()
+
+	for i := 0; i < 9; i++ {
+		Nil(t, pq.Put(0, []byte{0}))
+	}
+	for i := 0; i < 3; i++ {
+		Nil(t, pq.Put(1, []byte{1}))
+	}
+
+	// the low priority level gets 1 out of every 4 reads
+	for i := 0; i < 12; i++ {
+		if i%4 == 3 {
+			Equal(t, []byte{1}, <-pq.ReadChan())
+		} else {
+			Equal(t, []byte{0}, <-pq.ReadChan())
+		}
+	}
+	Equal(t, int64(0), pq.Depth())
+
+	_, err = NewPriority(pqName, tmpDir, 2, []int{3}, Options{}, l)
+	NotNil(t, err)
+}
+
+func TestPriorityQueueDiskSizeLimit(t *testing.T) {
+	l := NewTestLogger(t)
+	pqName := "test_priority_queue_disk_size_limit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pq, err := NewPriority(pqName, tmpDir, 2, nil, Options{
+		MaxBytesDiskSpace: 500,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+	}, l)
+	Nil(t, err)
+	defer pq.Close()
+
+	// 14 bytes per message, 7 messages and their count (106 bytes) per file,
+	// the 2 metadata files take up 112 bytes
+	msg := make([]byte, 10)
+	for i := 0; i < 24; i++ {
+		Nil(t, pq.Put(1, msg))
+	}
+	Equal(t, int64(24), pq.Depth())
+
+	// room is made by evicting the oldest low priority file
+	for i := 0; i < 6; i++ {
+		Nil(t, pq.Put(0, msg))
+	}
+	Equal(t, int64(6), pq.LevelDepth(0))
+	Equal(t, int64(17), pq.LevelDepth(1))
+	assertFileNotExist(t, pq.levels[1].fileName(0))
+}
+
+func TestPriorityQueueEvictOffered(t *testing.T) {
+	l := NewTestLogger(t)
+	pqName := "test_priority_queue_evict_offered" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pq, err := NewPriority(pqName, tmpDir, 2, nil, Options{
+		MaxBytesDiskSpace: 500,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+	}, l)
+	Nil(t, err)
+
+	// 7 messages per file
+	for i := 0; i < 8; i++ {
+		Nil(t, pq.Put(0, []byte{byte(i), 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the file of the message being offered is evicted before it is received
+	pq.levels[0].evictChan <- 1
+	Nil(t, <-pq.levels[0].evictResponseChan)
+	Equal(t, byte(0), (<-pq.ReadChan())[0])
+
+	// which does not consume the message that followed it
+	select {
+	case msg := <-pq.ReadChan():
+		Equal(t, byte(7), msg[0])
+	case <-time.After(time.Second):
+		t.Fatal("message following the evicted one was lost")
+	}
+	Equal(t, int64(0), pq.Depth())
+
+	Nil(t, pq.Close())
+	_, ok := <-pq.ReadChan()
+	Equal(t, false, ok)
+	Nil(t, pq.Close())
+}
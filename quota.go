@@ -0,0 +1,100 @@
+package diskqueue
+
+import (
+	"fmt"
+)
+
+// FullPolicy decides what happens to a write once the queue holds MaxDepth
+// messages or reached MaxBytesDiskSpace
+type FullPolicy int
+
+const (
+	// FullEvictOldest drops the oldest pending messages to make room, one
+	// at a time for MaxDepth and a file at a time for MaxBytesDiskSpace
+	FullEvictOldest FullPolicy = iota
+	// FullReject fails the write with ErrQueueFull, or ErrDiskFull
+	FullReject
+	// FullBlock makes Put() wait until readers made room, or the queue is
+	// closed. Writes that are not made by Put() fail like with FullReject
+	FullBlock
+)
+
+// checkDepth makes room for n more messages under maxDepth, as fullPolicy
+// says
+func (d *diskQueue) checkDepth(n int64) error {
+	if d.maxDepth <= 0 {
+		return nil
+	}
+	if n > d.maxDepth {
+		return fmt.Errorf("%w: %d messages surpass maxDepth(%d)", ErrQueueFull, n, d.maxDepth)
+	}
+
+	for d.pending()+n > d.maxDepth {
+		// delayed messages are not evicted before they are due
+		if d.fullPolicy != FullEvictOldest || d.depth == 0 {
+			return ErrQueueFull
+		}
+		err := d.evictOldestMessage()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pending is the number of messages reported by Depth()
+func (d *diskQueue) pending() int64 {
+	return d.depth + int64(len(d.delayed))
+}
+
+// evictOldestMessage consumes the message at the read position without
+// handing it to readers
+func (d *diskQueue) evictOldestMessage() error {
+	if d.readAhead != nil {
+		// whatever was decoded ahead starts with the evicted message
+		d.stopReadAhead()
+		// and readFile was left behind by the read-ahead goroutine
+		if d.readFile != nil {
+			d.closeReadFile()
+		}
+	}
+
+	if d.nextReadFileNum == d.readFileNum && d.nextReadPos == d.readPos {
+		// not read yet, which tells where the next message starts
+		f, err := d.readOne()
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) reading at %d of %s - %s",
+				d.name, d.readPos, d.fileName(d.readFileNum), err)
+			d.handleReadError()
+			return err
+		}
+		d.releaseFrame(f)
+	}
+
+	d.moveForward()
+	return nil
+}
+
+// freed returns a channel that is closed once messages or disk space were
+// freed, see FullBlock
+func (d *diskQueue) freed() chan int {
+	d.freedMtx.Lock()
+	defer d.freedMtx.Unlock()
+
+	if d.freedChan == nil {
+		d.freedChan = make(chan int)
+	}
+	return d.freedChan
+}
+
+// wakeBlocked wakes up the writers waiting on freed(), called by ioLoop
+func (d *diskQueue) wakeBlocked() {
+	d.freedMtx.Lock()
+	defer d.freedMtx.Unlock()
+
+	if d.freedChan != nil {
+		close(d.freedChan)
+		d.freedChan = nil
+	}
+}
@@ -0,0 +1,193 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueMaxDepthEvict(t *testing.T) {
+	// with messages read by ioLoop, and by the read-ahead goroutine
+	for _, readAhead := range []int{0, 4} {
+		testDiskQueueMaxDepthEvict(t, readAhead)
+	}
+}
+
+func testDiskQueueMaxDepthEvict(t *testing.T, readAhead int) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_depth_evict" + strconv.Itoa(readAhead) + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 20,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        3,
+		ReadAhead:       readAhead,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	// the oldest messages are evicted one at a time, across files
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		Equal(t, int64(min64(int64(i+1), 3)), dq.Depth())
+	}
+	Equal(t, []byte("7"), <-dq.ReadChan())
+	Nil(t, dq.Put([]byte("10")))
+	Nil(t, dq.Put([]byte("11")))
+	Equal(t, int64(3), dq.Depth())
+	dq.Close()
+
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Equal(t, int64(3), dq.Depth())
+	for _, expected := range []string{"9", "10", "11"} {
+		Equal(t, []byte(expected), <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+
+	tx, err := dq.(Transactor).Begin()
+	Nil(t, err)
+	for i := 0; i < 4; i++ {
+		Nil(t, tx.Put([]byte(strconv.Itoa(i))))
+	}
+	NotNil(t, tx.Commit())
+	dq.Close()
+}
+
+func TestDiskQueueMaxDepthReject(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_depth_reject" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        2,
+		FullPolicy:      FullReject,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("b"), time.Now().Add(time.Hour)))
+	// delayed messages count too
+	Equal(t, ErrQueueFull, dq.Put([]byte("c")))
+	Equal(t, int64(2), dq.Depth())
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	Nil(t, dq.Put([]byte("c")))
+	Equal(t, ErrQueueFull, dq.Put([]byte("d")))
+
+	// as do transactions that could never fit
+	tx, err := dq.(Transactor).Begin()
+	Nil(t, err)
+	for i := 0; i < 3; i++ {
+		Nil(t, tx.Put([]byte("e")))
+	}
+	Equal(t, true, errors.Is(tx.Commit(), ErrQueueFull))
+	dq.Close()
+}
+
+func TestDiskQueueMaxDepthBlock(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_max_depth_block" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        2,
+		FullPolicy:      FullBlock,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+	putErr := make(chan error)
+	go func() {
+		putErr <- dq.Put([]byte("c"))
+	}()
+	select {
+	case <-putErr:
+		t.Fatal("Put() did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	Nil(t, <-putErr)
+	Equal(t, int64(2), dq.Depth())
+
+	// blocked writers are released when the queue is closed
+	go func() {
+		putErr <- dq.Put([]byte("d"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dq.Close()
+	NotNil(t, <-putErr)
+}
+
+func TestDiskSizeImplementationFullReject(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_implementation_full_reject" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesDiskSpace: 6040,
+		MaxBytesPerFile:   1 << 11,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		FullPolicy:        FullReject,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	msg := make([]byte, 1000)
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	// unread data is not evicted
+	Equal(t, true, errors.Is(dq.Put(msg), ErrDiskFull))
+	Equal(t, int64(5), dq.Depth())
+
+	// until the first file was read
+	for i := 0; i < 3; i++ {
+		<-dq.ReadChan()
+	}
+	Nil(t, dq.Put(msg))
+	Equal(t, int64(3), dq.Depth())
+	dq.Close()
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,238 @@
+package diskqueue
+
+import (
+	"io"
+	"math"
+)
+
+// readAhead decodes the messages that follow the read position in its own
+// goroutine, so that a slow disk read does not hold up writes and the other
+// requests served by ioLoop
+//
+// it keeps its own read cursor, which only ever moves forward: ioLoop tells it
+// how far the data goes as it is written and replaces it whenever the read
+// position is moved by anything other than a delivery (Empty(), RewindTo(),
+// evictions, read errors, ...)
+type readAhead struct {
+	d *diskQueue // only its instantiation time metadata is used
+
+	// only touched by loop()
+	fileNum      int64
+	pos          int64
+	file         File
+	reader       io.Reader
+	mapping      []byte
+	end          int64 // where the messages of file end, -1 while it is written to
+	writeFileNum int64
+	writePos     int64
+
+	// only touched by ioLoop
+	nextFileNum  int64 // where the next result received from resultChan starts
+	nextPos      int64
+	limitFileNum int64 // the last write position sent over limitChan
+	limitPos     int64
+
+	resultChan   chan readResult
+	limitChan    chan readLimit
+	exitChan     chan int
+	exitSyncChan chan int
+}
+
+// readResult is a decoded message along with where the following one starts
+type readResult struct {
+	frame       frame
+	nextFileNum int64
+	nextPos     int64
+	err         error
+}
+
+// readLimit is the write position, i.e. how far there is data to read
+type readLimit struct {
+	fileNum int64
+	pos     int64
+}
+
+// startReadAhead starts decoding messages from the read position onwards
+func (d *diskQueue) startReadAhead() {
+	r := &readAhead{
+		d:            d,
+		fileNum:      d.nextReadFileNum,
+		pos:          d.nextReadPos,
+		end:          -1,
+		writeFileNum: d.writeFileNum,
+		writePos:     d.writePos,
+		nextFileNum:  d.nextReadFileNum,
+		nextPos:      d.nextReadPos,
+		limitFileNum: d.writeFileNum,
+		limitPos:     d.writePos,
+		// the message loop() holds while the channel is full makes up the rest
+		resultChan:   make(chan readResult, d.readAheadSize-1),
+		limitChan:    make(chan readLimit, 1),
+		exitChan:     make(chan int),
+		exitSyncChan: make(chan int),
+	}
+
+	go r.loop()
+
+	d.readAhead = r
+}
+
+// stopReadAhead stops the read-ahead goroutine and drops whatever it decoded
+func (d *diskQueue) stopReadAhead() {
+	if d.readAhead == nil {
+		return
+	}
+
+	close(d.readAhead.exitChan)
+	// ensure that loop has exited
+	<-d.readAhead.exitSyncChan
+
+	d.readAhead = nil
+}
+
+// syncReadAhead makes sure the read-ahead goroutine decodes from the position
+// ioLoop reads from next and knows about everything that was written
+func (d *diskQueue) syncReadAhead() {
+	if d.readAhead != nil &&
+		(d.readAhead.nextFileNum != d.nextReadFileNum || d.readAhead.nextPos != d.nextReadPos) {
+		d.stopReadAhead()
+	}
+
+	if d.readAhead == nil {
+		if d.nextReadFileNum == d.writeFileNum && d.nextReadPos == d.writePos {
+			// nothing to read, started once there is
+			return
+		}
+		d.startReadAhead()
+		return
+	}
+
+	d.readAhead.setLimit(d.writeFileNum, d.writePos)
+}
+
+// setLimit hands the write position over to loop() without blocking on it
+func (r *readAhead) setLimit(fileNum int64, pos int64) {
+	if fileNum == r.limitFileNum && pos == r.limitPos {
+		return
+	}
+	r.limitFileNum = fileNum
+	r.limitPos = pos
+
+	limit := readLimit{fileNum, pos}
+	select {
+	case r.limitChan <- limit:
+	default:
+		// replace the one loop() has not picked up yet,
+		// ioLoop is the only sender so there is room afterwards
+		select {
+		case <-r.limitChan:
+		default:
+		}
+		r.limitChan <- limit
+	}
+}
+
+// received advances the position the next result starts from
+func (r *readAhead) received(res readResult) {
+	r.nextFileNum = res.nextFileNum
+	r.nextPos = res.nextPos
+}
+
+func (r *readAhead) loop() {
+	var res readResult
+	var out chan readResult
+	var failed bool
+
+	for {
+		if out == nil && !failed && (r.fileNum < r.writeFileNum || r.pos < r.writePos) {
+			res = r.readOne()
+			out = r.resultChan
+		}
+
+		select {
+		case out <- res:
+			out = nil
+			if res.err != nil {
+				// ioLoop replaces us once it handled the error
+				failed = true
+			}
+		case limit := <-r.limitChan:
+			r.writeFileNum = limit.fileNum
+			r.writePos = limit.pos
+		case <-r.exitChan:
+			goto exit
+		}
+	}
+
+exit:
+	if r.file != nil {
+		r.d.closeMappedFile(r.file, r.mapping)
+	}
+	r.exitSyncChan <- 1
+}
+
+// readOne decodes the message at the cursor, rolling over to the next file
+// once a complete file has been read to its end
+func (r *readAhead) readOne() readResult {
+	var res readResult
+	var err error
+
+	if r.file == nil {
+		r.file, r.mapping, r.end, err = r.d.openReadFile(r.fileNum, r.pos, r.fileNum < r.writeFileNum)
+		if err != nil {
+			return readResult{err: err}
+		}
+
+		r.d.logf(INFO, "DISKQUEUE(%s): readAhead opened %s", r.d.name, r.file.Name())
+
+		var limit func() int64
+		if r.d.preallocateFiles && r.end < 0 {
+			fileNum := r.fileNum
+			limit = func() int64 {
+				if fileNum < r.writeFileNum {
+					// trimmed when it was rolled
+					return math.MaxInt64
+				}
+				return r.writePos
+			}
+		}
+		r.reader = newFileReader(r.file, r.mapping, r.pos, limit)
+	}
+
+	if r.end < 0 && r.fileNum < r.writeFileNum {
+		// the file was completed since it was opened, which happens along
+		// with writing its last message so that one was not read yet
+		r.end, err = r.d.dataEnd(r.file)
+		if err != nil {
+			r.close()
+			return readResult{err: err}
+		}
+	}
+
+	f, totalBytes, err := r.d.readFrame(r.reader)
+	if err != nil {
+		r.close()
+		return readResult{err: err}
+	}
+	res.frame = f
+	r.pos += totalBytes
+
+	// we only consider rotating if we're reading a "complete" file
+	if r.end >= 0 && r.pos >= r.end {
+		r.close()
+		r.fileNum++
+		r.pos = 0
+	}
+
+	res.nextFileNum = r.fileNum
+	res.nextPos = r.pos
+	return res
+}
+
+func (r *readAhead) close() {
+	r.d.closeMappedFile(r.file, r.mapping)
+	r.file = nil
+	r.mapping = nil
+	r.reader = nil
+	r.end = -1
+}
@@ -0,0 +1,160 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueReadAhead(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_ahead" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		opts := Options{
+			MaxBytesDiskSpace: diskLimit,
+			MaxBytesPerFile:   100,
+			MinMsgSize:        0,
+			MaxMsgSize:        1 << 10,
+			SyncEvery:         2500,
+			SyncTimeout:       2 * time.Second,
+			ReadAhead:         4,
+		}
+		name := dqName + strconv.Itoa(int(diskLimit))
+		dq := NewWithOptions(name, tmpDir, opts, l)
+		NotNil(t, dq)
+
+		for i := 0; i < 30; i++ {
+			Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		// decoding ahead does not move the read position
+		Equal(t, int64(30), dq.Depth())
+		Equal(t, int64(0), dq.(*diskQueue).readFileNum)
+		Equal(t, int64(0), dq.(*diskQueue).readPos)
+
+		for i := 0; i < 10; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		Equal(t, int64(20), dq.Depth())
+		dq.Close()
+
+		// resumes from the last delivered message after a restart
+		dq = NewWithOptions(name, tmpDir, opts, l)
+		Equal(t, int64(20), dq.Depth())
+		for i := 10; i < 30; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+			Nil(t, dq.Put([]byte(strconv.Itoa(i+20))))
+		}
+		for i := 30; i < 50; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		Equal(t, int64(0), dq.Depth())
+
+		// a file opened while it is written to is rolled over once complete
+		Nil(t, dq.Put([]byte("a")))
+		Equal(t, []byte("a"), <-dq.ReadChan())
+		for i := 0; i < 20; i++ {
+			Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+		}
+		for i := 0; i < 20; i++ {
+			Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+		}
+		Equal(t, int64(0), dq.Depth())
+		dq.Close()
+
+		dq = NewWithOptions(name, tmpDir, opts, l)
+		Equal(t, int64(0), dq.Depth())
+		Equal(t, int64(0), numberOfBadFiles(name, tmpDir))
+		dq.Close()
+	}
+}
+
+func TestDiskQueueReadAheadReset(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_ahead_reset" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		RetentionPeriod: time.Hour,
+		ReadAhead:       4,
+	}, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	for i := 0; i < 5; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// messages that were decoded ahead are dropped by a rewind
+	Nil(t, dq.(Rewinder).RewindTo(time.Time{}))
+	Equal(t, int64(10), dq.Depth())
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte{byte(i)}, <-dq.ReadChan())
+	}
+
+	// and by Empty()
+	for i := 0; i < 10; i++ {
+		Nil(t, dq.Put([]byte{byte(i)}))
+	}
+	time.Sleep(10 * time.Millisecond)
+	Nil(t, dq.Empty())
+	Equal(t, int64(0), dq.Depth())
+	Nil(t, dq.Put([]byte{10}))
+	Equal(t, []byte{10}, <-dq.ReadChan())
+}
+
+func TestDiskQueueReadAheadCorruption(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_read_ahead_corruption" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 1000,
+		MinMsgSize:      10,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       5,
+		SyncTimeout:     2 * time.Second,
+		ReadAhead:       4,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+
+	msg := make([]byte, 123) // 127 bytes per message, 8 (1016 bytes) messages per file
+	for i := 0; i < 25; i++ {
+		Nil(t, dq.Put(msg))
+	}
+	dq.Close()
+
+	// corrupt the 2nd file
+	os.Truncate(dq.(*diskQueue).fileName(1), 500) // 3 valid messages, 5 corrupted
+
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	defer dq.Close()
+	for i := 0; i < 20; i++ {
+		Equal(t, msg, <-dq.ReadChan())
+	}
+	Equal(t, int64(0), dq.Depth())
+	Equal(t, int64(1), numberOfBadFiles(dqName, tmpDir))
+}
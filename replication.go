@@ -0,0 +1,738 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replicator is implemented by queues that can stream everything they write
+// to followers, see NewFollower()
+type Replicator interface {
+	// AddFollower starts replicating to the follower at the other end of conn,
+	// beginning with a copy of the files the queue currently holds
+	//
+	// conn is owned by the queue from then on and closed along with it
+	AddFollower(conn net.Conn) error
+}
+
+// record types of the replication stream
+//
+// every record starts with its type, its sequence number and the base name
+// of the file it applies to. Files are addressed by name so that the
+// follower does not have to know the queue's settings
+const (
+	recordReset  byte = iota + 1 // remove every file of the queue named like the file
+	recordWrite                  // pos int64, len int32, data
+	recordFile                   // len int32, data replacing the whole file
+	recordRemove                 // no fields
+	recordRename                 // the new name
+)
+
+// replicaChunkSize is the size of the writes a snapshot is split into, no
+// record carries more data than that, so it is also the most a follower
+// reads at once
+const replicaChunkSize = 1 << 20
+
+// followerMaxFiles is the number of files a follower keeps open between
+// metadata updates, e.g. a data file along with the delayed file and the
+// dedup index
+const followerMaxFiles = 8
+
+// replicaBacklog is the number of records queued for a follower before
+// ioLoop has to wait for it
+const replicaBacklog = 1024
+
+// replicaSet holds the followers of a queue
+//
+// only ioLoop (or exit, once ioLoop is done) adds records and followers,
+// the lock guards the followers and their acks for the waiting puts
+type replicaSet struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	seq int64 // sequence number of the last record
+
+	sync.Mutex
+	replicas  []*replica
+	ackNotify chan int // closed and replaced whenever a follower acked
+	exitChan  chan int
+}
+
+// replica streams records to a single follower
+type replica struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	ackSeq int64 // sequence number of the last record the follower applied
+
+	conn       net.Conn
+	recordChan chan []byte
+	failedChan chan int // closed by send once conn failed
+	sendDone   chan int
+	ackDone    chan int
+}
+
+func newReplicaSet() *replicaSet {
+	return &replicaSet{
+		ackNotify: make(chan int),
+		exitChan:  make(chan int),
+	}
+}
+
+// AddFollower starts replicating to the follower at the other end of conn
+func (d *diskQueue) AddFollower(conn net.Conn) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.state != stateOpen {
+		return ErrClosed
+	}
+
+	d.followChan <- conn
+	return <-d.followResponseChan
+}
+
+// addFollower registers a follower and sends it a snapshot of the queue:
+// every data file it holds, its delayed file and dedup index, followed by
+// the metadata
+func (d *diskQueue) addFollower(conn net.Conn) error {
+	rs := d.replication
+	r := &replica{
+		ackSeq:     -1,
+		conn:       conn,
+		recordChan: make(chan []byte, replicaBacklog),
+		failedChan: make(chan int),
+		sendDone:   make(chan int),
+		ackDone:    make(chan int),
+	}
+	go d.sendRecords(r)
+	go d.receiveAcks(r)
+
+	d.logf(INFO, "DISKQUEUE(%s): replicating to %s", d.name, conn.RemoteAddr())
+
+	// the snapshot is only sent to the new follower, its records share the
+	// sequence number of the last record sent to the others
+	seq := d.replication.seq
+	send := func(rec []byte) error {
+		select {
+		case r.recordChan <- rec:
+			return nil
+		case <-r.failedChan:
+			return errors.New("follower disconnected")
+		}
+	}
+
+	// the follower starts over from the files it is sent
+	err := send(encodeRecord(recordReset, seq, d.metaDataFileName(), nil))
+
+	firstFileNum := d.readFileNum
+	if d.retainedFileNum < firstFileNum {
+		firstFileNum = d.retainedFileNum
+	}
+	for i := firstFileNum; i <= d.writeFileNum && err == nil; i++ {
+		var data []byte
+		data, err = readFile(d.fs, d.fileName(i))
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			continue
+		}
+		if i == d.writeFileNum && int64(len(data)) > d.writePos {
+			// the preallocated tail
+			data = data[:d.writePos]
+		}
+		err = sendChunks(send, seq, d.fileName(i), data)
+	}
+
+	// along with the messages held back by PutDelayed() and the keys
+	// remembered by PutIdempotent()
+	for _, fileName := range []string{d.delayedFileName(), d.dedupFileName()} {
+		if err != nil {
+			break
+		}
+		var data []byte
+		data, err = readFile(d.fs, fileName)
+		if err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			continue
+		}
+		err = sendChunks(send, seq, fileName, data)
+	}
+	if err != nil {
+		close(r.recordChan)
+		<-r.sendDone
+		r.conn.Close()
+		<-r.ackDone
+		return err
+	}
+
+	rs.Lock()
+	rs.replicas = append(rs.replicas, r)
+	rs.Unlock()
+
+	// the metadata that goes with the snapshot
+	return d.sync()
+}
+
+// sendChunks sends the content of the file fileName as writes of up to
+// replicaChunkSize
+func sendChunks(send func([]byte) error, seq int64, fileName string, data []byte) error {
+	var err error
+	for pos := 0; pos < len(data) && err == nil; pos += replicaChunkSize {
+		end := pos + replicaChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		err = send(encodeWrite(seq, fileName, int64(pos), data[pos:end]))
+	}
+	return err
+}
+
+// replicateWrite streams data written at pos of the file fileName
+func (d *diskQueue) replicateWrite(fileName string, pos int64, data []byte) {
+	if len(d.replication.replicas) == 0 {
+		return
+	}
+	for len(data) > replicaChunkSize {
+		d.replicate(encodeWrite(d.replication.seq+1, fileName, pos, data[:replicaChunkSize]))
+		pos += replicaChunkSize
+		data = data[replicaChunkSize:]
+	}
+	d.replicate(encodeWrite(d.replication.seq+1, fileName, pos, data))
+}
+
+// replicateFile streams the whole content of the file fileName, what does
+// not fit in the first chunk follows as writes
+func (d *diskQueue) replicateFile(fileName string, data []byte) {
+	if len(d.replication.replicas) == 0 {
+		return
+	}
+	n := len(data)
+	if n > replicaChunkSize {
+		n = replicaChunkSize
+	}
+	d.replicate(encodeRecord(recordFile, d.replication.seq+1, fileName, nil, data[:n]))
+	if n < len(data) {
+		d.replicateWrite(fileName, int64(n), data[n:])
+	}
+}
+
+// replicateRemove streams the removal of the file fileName
+func (d *diskQueue) replicateRemove(fileName string) {
+	if len(d.replication.replicas) == 0 {
+		return
+	}
+	d.replicate(encodeRecord(recordRemove, d.replication.seq+1, fileName, nil))
+}
+
+// replicateRename streams the renaming of the file fileName to newName
+func (d *diskQueue) replicateRename(fileName string, newName string) {
+	if len(d.replication.replicas) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	writeName(&buf, path.Base(newName))
+	d.replicate(encodeRecord(recordRename, d.replication.seq+1, fileName, buf.Bytes()))
+}
+
+// replicate queues the next record for every follower, the followers whose
+// connection failed are dropped
+func (d *diskQueue) replicate(rec []byte) {
+	rs := d.replication
+
+	var failed bool
+	for _, r := range rs.replicas {
+		select {
+		case r.recordChan <- rec:
+		case <-r.failedChan:
+			failed = true
+		}
+	}
+
+	atomic.AddInt64(&rs.seq, 1)
+
+	if failed {
+		rs.Lock()
+		replicas := rs.replicas[:0]
+		for _, r := range rs.replicas {
+			select {
+			case <-r.failedChan:
+				close(r.recordChan)
+				<-r.sendDone
+			default:
+				replicas = append(replicas, r)
+			}
+		}
+		rs.replicas = replicas
+		rs.Unlock()
+	}
+}
+
+// encodeRecord encodes a record, fields are appended as is and data is
+// length prefixed if given
+func encodeRecord(typ byte, seq int64, fileName string, fields []byte, data ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(typ)
+	writeInt64(&buf, seq)
+	writeName(&buf, path.Base(fileName))
+	buf.Write(fields)
+	for _, b := range data {
+		writeInt32(&buf, int32(len(b)))
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+func encodeWrite(seq int64, fileName string, pos int64, data []byte) []byte {
+	var posBuf [8]byte
+	binary.BigEndian.PutUint64(posBuf[:], uint64(pos))
+	return encodeRecord(recordWrite, seq, fileName, posBuf[:], data)
+}
+
+func writeName(buf *bytes.Buffer, name string) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(len(name)))
+	buf.Write(b[:])
+	buf.WriteString(name)
+}
+
+// sendRecords writes the records queued for a follower to its connection,
+// flushing whenever there are none left
+func (d *diskQueue) sendRecords(r *replica) {
+	w := bufio.NewWriter(r.conn)
+	var err error
+
+	for rec := range r.recordChan {
+		if err != nil {
+			// drained until the follower is dropped
+			continue
+		}
+
+		_, err = w.Write(rec)
+		if err == nil && len(r.recordChan) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to replicate to %s - %s", d.name, r.conn.RemoteAddr(), err)
+			r.conn.Close()
+			close(r.failedChan)
+		}
+	}
+
+	if err == nil {
+		// let the follower read everything before the connection goes away
+		if cw, ok := r.conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			select {
+			case <-r.ackDone:
+			case <-time.After(d.replicaAckTimeout):
+			}
+		}
+		r.conn.Close()
+	}
+
+	close(r.sendDone)
+}
+
+// receiveAcks reads the sequence numbers acked by a follower until its
+// connection is closed
+func (d *diskQueue) receiveAcks(r *replica) {
+	rs := d.replication
+	reader := bufio.NewReader(r.conn)
+	var ack [8]byte
+
+	for {
+		_, err := io.ReadFull(reader, ack[:])
+		if err != nil {
+			break
+		}
+
+		atomic.StoreInt64(&r.ackSeq, int64(binary.BigEndian.Uint64(ack[:])))
+
+		rs.Lock()
+		close(rs.ackNotify)
+		rs.ackNotify = make(chan int)
+		rs.Unlock()
+	}
+
+	close(r.ackDone)
+}
+
+// waitReplicaAcks waits until replicaAcks followers applied everything, it
+// does not wait when there are no followers
+// written up to now
+func (d *diskQueue) waitReplicaAcks() error {
+	rs := d.replication
+	seq := atomic.LoadInt64(&rs.seq)
+
+	rs.Lock()
+	followers := len(rs.replicas)
+	rs.Unlock()
+	if followers == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d.replicaAckTimeout)
+	defer timer.Stop()
+
+	for {
+		rs.Lock()
+		var acks int
+		for _, r := range rs.replicas {
+			if atomic.LoadInt64(&r.ackSeq) >= seq {
+				acks++
+			}
+		}
+		ackNotify := rs.ackNotify
+		rs.Unlock()
+
+		if acks >= d.replicaAcks {
+			return nil
+		}
+
+		select {
+		case <-ackNotify:
+		case <-timer.C:
+			return fmt.Errorf("%w: written but acked by %d of %d followers within %s",
+				ErrReplicaAcks, acks, d.replicaAcks, d.replicaAckTimeout)
+		case <-rs.exitChan:
+			return ErrClosed
+		}
+	}
+}
+
+// closeReplicas sends the followers whatever is left and disconnects them
+func (d *diskQueue) closeReplicas() {
+	rs := d.replication
+
+	rs.Lock()
+	replicas := rs.replicas
+	rs.replicas = nil
+	rs.Unlock()
+
+	close(rs.exitChan)
+
+	for _, r := range replicas {
+		close(r.recordChan)
+		<-r.sendDone
+		<-r.ackDone
+	}
+}
+
+// Follower maintains a copy of the files of a queue from the records the
+// queue streams to it, a queue created from the follower's folder (once the
+// stream ended) resumes where the original was
+type Follower struct {
+	closing int32
+
+	dataPath string
+	conn     net.Conn
+	fs       FS
+	logf     AppLogFunc
+
+	// only touched by loop
+	files map[string]File // written to, synced along with the metadata
+	err   error
+
+	exitSyncChan chan int
+}
+
+// NewFollower starts applying the records streamed by a queue on conn to
+// files in dataPath
+func NewFollower(dataPath string, conn net.Conn, logf AppLogFunc) *Follower {
+	return NewFollowerWithFS(dataPath, conn, OSFS{}, logf)
+}
+
+// NewFollowerWithFS is NewFollower with the files written through fs, which
+// should be the FS of the queue that is later created from dataPath
+func NewFollowerWithFS(dataPath string, conn net.Conn, fs FS, logf AppLogFunc) *Follower {
+	f := Follower{
+		dataPath:     dataPath,
+		conn:         conn,
+		fs:           fs,
+		logf:         logf,
+		files:        make(map[string]File),
+		exitSyncChan: make(chan int),
+	}
+
+	go f.loop()
+
+	return &f
+}
+
+// Close stops following and closes the connection
+func (f *Follower) Close() error {
+	atomic.StoreInt32(&f.closing, 1)
+	f.conn.Close()
+	return f.Wait()
+}
+
+// Wait blocks until the stream ended, it returns nil if it was closed by
+// the queue
+func (f *Follower) Wait() error {
+	<-f.exitSyncChan
+	// exitSyncChan is closed, err is no longer written to
+	return f.err
+}
+
+func (f *Follower) loop() {
+	reader := bufio.NewReader(f.conn)
+	var ack [8]byte
+	var acking = true
+
+	for {
+		seq, err := f.applyRecord(reader)
+		if err != nil {
+			if err != io.EOF && atomic.LoadInt32(&f.closing) == 0 {
+				f.logf(ERROR, "FOLLOWER(%s) failed to apply record - %s", f.dataPath, err)
+				f.err = err
+			}
+			break
+		}
+
+		// acks are cumulative, so only the last of a batch is sent, once
+		// what it covers is synced
+		if acking && reader.Buffered() == 0 {
+			err = f.syncFiles()
+			if err != nil {
+				f.logf(ERROR, "FOLLOWER(%s) failed to sync - %s", f.dataPath, err)
+				f.err = err
+				break
+			}
+			binary.BigEndian.PutUint64(ack[:], uint64(seq))
+			_, err = f.conn.Write(ack[:])
+			if err != nil {
+				// the queue may be done with us, keep applying what it sent
+				acking = false
+			}
+		}
+	}
+
+	f.syncFiles()
+	f.closeFiles()
+	f.conn.Close()
+
+	close(f.exitSyncChan)
+}
+
+// applyRecord reads a record and applies it, returning its sequence number
+func (f *Follower) applyRecord(reader *bufio.Reader) (int64, error) {
+	var header [9]byte
+	_, err := io.ReadFull(reader, header[:])
+	if err != nil {
+		return 0, err
+	}
+	typ := header[0]
+	seq := int64(binary.BigEndian.Uint64(header[1:9]))
+
+	name, err := readName(reader, header[:2])
+	if err != nil {
+		return 0, err
+	}
+
+	switch typ {
+	case recordReset:
+		err = f.reset(name)
+	case recordWrite:
+		var pos int64
+		var data []byte
+		pos, err = readInt64(reader, header[:8])
+		if err == nil {
+			data, err = readData(reader)
+		}
+		if err == nil {
+			err = f.write(name, pos, data)
+		}
+	case recordFile:
+		var data []byte
+		data, err = readData(reader)
+		if err == nil {
+			err = f.replace(name, data)
+		}
+	case recordRemove:
+		err = f.remove(name)
+	case recordRename:
+		var newName string
+		newName, err = readName(reader, header[:2])
+		if err == nil {
+			err = f.rename(name, newName)
+		}
+	default:
+		err = fmt.Errorf("invalid record type (%d)", typ)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return seq, err
+}
+
+func readName(r io.Reader, scratch []byte) (string, error) {
+	_, err := io.ReadFull(r, scratch[:2])
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, binary.BigEndian.Uint16(scratch[:2]))
+	_, err = io.ReadFull(r, name)
+	if err != nil {
+		return "", err
+	}
+
+	// only files in dataPath are written to
+	if len(name) == 0 || filepath.Base(string(name)) != string(name) {
+		return "", fmt.Errorf("invalid file name (%q)", name)
+	}
+	return string(name), nil
+}
+
+func readData(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 0 || n > replicaChunkSize {
+		return nil, fmt.Errorf("invalid record size (%d)", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+// reset removes the files of the queue whose metadata file is metaName,
+// before a snapshot of it is applied
+func (f *Follower) reset(metaName string) error {
+	if !strings.HasSuffix(metaName, ".diskqueue.meta.dat") {
+		return fmt.Errorf("invalid metadata file name (%q)", metaName)
+	}
+	f.closeFiles()
+
+	prefix := metaName[:len(metaName)-len("meta.dat")]
+	fileInfos, err := f.fs.ReadDir(f.dataPath)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if len(name) > len(prefix) && name[:len(prefix)] == prefix {
+			err = f.fs.Remove(filepath.Join(f.dataPath, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	f.logf(INFO, "FOLLOWER(%s): reset %s*", f.dataPath, prefix)
+	return nil
+}
+
+func (f *Follower) write(name string, pos int64, data []byte) error {
+	file, ok := f.files[name]
+	if !ok {
+		if len(f.files) >= followerMaxFiles {
+			// they are synced before being closed, as the metadata
+			// that follows them only syncs the files still open
+			err := f.syncFiles()
+			if err != nil {
+				return err
+			}
+			f.closeFiles()
+		}
+
+		var err error
+		file, err = f.fs.OpenFile(filepath.Join(f.dataPath, name), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		f.files[name] = file
+	}
+
+	_, err := file.WriteAt(data, pos)
+	return err
+}
+
+// replace writes a whole file the way the metadata is persisted, after
+// syncing the data written before it
+func (f *Follower) replace(name string, data []byte) error {
+	err := f.syncFiles()
+	if err != nil {
+		return err
+	}
+	// the file written to before is replaced, e.g. a compacted delayed file
+	f.closeFile(name)
+
+	fileName := filepath.Join(f.dataPath, name)
+	tmpFileName := fileName + ".tmp"
+	file, err := f.fs.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	file.Sync()
+	file.Close()
+
+	return f.fs.Rename(tmpFileName, fileName)
+}
+
+func (f *Follower) remove(name string) error {
+	f.closeFile(name)
+
+	err := f.fs.Remove(filepath.Join(f.dataPath, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (f *Follower) rename(name string, newName string) error {
+	f.closeFile(name)
+
+	err := f.fs.Rename(filepath.Join(f.dataPath, name), filepath.Join(f.dataPath, newName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// syncFiles syncs every file written to since they were opened
+func (f *Follower) syncFiles() error {
+	for _, file := range f.files {
+		err := file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Follower) closeFile(name string) {
+	file, ok := f.files[name]
+	if ok {
+		file.Close()
+		delete(f.files, name)
+	}
+}
+
+func (f *Follower) closeFiles() {
+	for name, file := range f.files {
+		file.Close()
+		delete(f.files, name)
+	}
+}
@@ -0,0 +1,351 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// assertSameFiles checks that both folders hold the same files with the
+// same content
+func assertSameFiles(t *testing.T, expectedDir string, actualDir string) {
+	expected, err := ioutil.ReadDir(expectedDir)
+	Nil(t, err)
+	actual, err := ioutil.ReadDir(actualDir)
+	Nil(t, err)
+	Equal(t, len(expected), len(actual))
+
+	for i, fileInfo := range expected {
+		Equal(t, fileInfo.Name(), actual[i].Name())
+		expectedData, err := ioutil.ReadFile(filepath.Join(expectedDir, fileInfo.Name()))
+		Nil(t, err)
+		actualData, err := ioutil.ReadFile(filepath.Join(actualDir, fileInfo.Name()))
+		Nil(t, err)
+		Equal(t, expectedData, actualData)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       10,
+		SyncTimeout:     2 * time.Second,
+		ReplicaAcks:     1,
+	}
+	dq := NewWithOptions(dqName, primaryDir, opts, l)
+	NotNil(t, dq)
+
+	primaryConn, followerConn := net.Pipe()
+	f := NewFollower(followerDir, followerConn, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+
+	for i := 0; i < 50; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	for i := 0; i < 20; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	Nil(t, dq.Close())
+	Nil(t, f.Wait())
+	assertSameFiles(t, primaryDir, followerDir)
+
+	// the follower's copy takes over where the primary was
+	dq = NewWithOptions(dqName, followerDir, opts, l)
+	Equal(t, int64(30), dq.Depth())
+	for i := 20; i < 50; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	dq.Close()
+}
+
+func TestReplicationSnapshot(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication_snapshot" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	opts := Options{
+		MaxBytesDiskSpace: 1 << 20,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+	}
+	dq := NewWithOptions(dqName, primaryDir, opts, l)
+	NotNil(t, dq)
+
+	for i := 0; i < 20; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	for i := 0; i < 10; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+
+	// a stale copy is replaced by the snapshot
+	Nil(t, ioutil.WriteFile(filepath.Join(followerDir, dqName+".diskqueue.000000.dat"), []byte("stale"), 0600))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Nil(t, err)
+	defer ln.Close()
+	followerChan := make(chan *Follower)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(err)
+		}
+		followerChan <- NewFollower(followerDir, conn, l)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	Nil(t, err)
+	Nil(t, dq.(Replicator).AddFollower(conn))
+	f := <-followerChan
+
+	for i := 20; i < 40; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	for i := 10; i < 25; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+	Nil(t, dq.Empty())
+	for i := 0; i < 5; i++ {
+		Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+	}
+	Nil(t, dq.Close())
+	Nil(t, f.Wait())
+	assertSameFiles(t, primaryDir, followerDir)
+
+	dq = NewWithOptions(dqName, followerDir, opts, l)
+	Equal(t, int64(5), dq.Depth())
+	Equal(t, []byte("0"), <-dq.ReadChan())
+	dq.Close()
+}
+
+func TestReplicationDelayedDedup(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication_delayed_dedup" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       10,
+		SyncTimeout:     2 * time.Second,
+		DedupWindow:     time.Hour,
+	}
+	dq := NewWithOptions(dqName, primaryDir, opts, l)
+	NotNil(t, dq)
+
+	// the snapshot holds what is pending in the delayed file and the
+	// remembered keys
+	later := time.Now().Add(time.Hour)
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("later0"), later))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+
+	primaryConn, followerConn := net.Pipe()
+	f := NewFollower(followerDir, followerConn, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+
+	// and both files are replicated once it started
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("later1"), later))
+	Nil(t, dq.(DelayedPutter).PutDelayed([]byte("soon"), time.Now().Add(50*time.Millisecond)))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("b", []byte("b")))
+	Equal(t, []byte("a"), <-dq.ReadChan())
+	Equal(t, []byte("b"), <-dq.ReadChan())
+	Equal(t, []byte("soon"), <-dq.ReadChan())
+	Nil(t, dq.Close())
+	Nil(t, f.Wait())
+	assertSameFiles(t, primaryDir, followerDir)
+
+	// the follower's copy still holds the delayed messages back, and
+	// remembers the keys
+	dq = NewWithOptions(dqName, followerDir, opts, l)
+	Equal(t, int64(2), dq.Depth())
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("a", []byte("a")))
+	Nil(t, dq.(IdempotentPutter).PutIdempotent("b", []byte("b")))
+	Equal(t, int64(2), dq.Depth())
+	select {
+	case msg := <-dq.ReadChan():
+		t.Fatalf("unexpected message %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+	dq.Close()
+}
+
+func TestReplicationAcks(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication_acks" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	dq := NewWithOptions(dqName, primaryDir, Options{
+		MaxBytesPerFile:   1024,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		ReplicaAcks:       2,
+		ReplicaAckTimeout: 50 * time.Millisecond,
+	}, l)
+	NotNil(t, dq)
+
+	// there is no follower to wait for
+	Nil(t, dq.Put([]byte("a")))
+
+	// the message is written, but not acked by enough followers
+	primaryConn, followerConn := net.Pipe()
+	f := NewFollower(followerDir, followerConn, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+	err = dq.Put([]byte("b"))
+	Equal(t, true, errors.Is(err, ErrReplicaAcks))
+
+	primaryConn, followerConn = net.Pipe()
+	f2 := NewFollower(filepath.Join(tmpDir), followerConn, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+	Nil(t, dq.Put([]byte("c")))
+	Equal(t, int64(3), dq.Depth())
+
+	// a follower that went away is dropped
+	Nil(t, f.Close())
+	Equal(t, true, errors.Is(dq.Put([]byte("d")), ErrReplicaAcks))
+	Equal(t, []byte("a"), <-dq.ReadChan())
+
+	dq.Close()
+	Nil(t, f2.Wait())
+}
+
+func TestReplicationFollowerFS(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication_follower_fs" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	dq := New(dqName, primaryDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	// the follower writes through its FS
+	ffs := NewFaultFS(OSFS{})
+	ffs.Inject(Fault{Op: OpWrite, Path: ".diskqueue.000000.dat", Err: syscall.ENOSPC})
+	primaryConn, followerConn := net.Pipe()
+	f := NewFollowerWithFS(followerDir, followerConn, ffs, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+
+	Nil(t, dq.Put([]byte("lost")))
+	err = f.Wait()
+	Equal(t, true, errors.Is(err, syscall.ENOSPC))
+	Equal(t, 1, ffs.Injected())
+	dq.Close()
+}
+
+func TestReplicationFollowerInvalidRecord(t *testing.T) {
+	l := NewTestLogger(t)
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// neither a name too short for a metadata file nor a size larger than
+	// a chunk is trusted
+	for _, rec := range [][]byte{
+		encodeRecord(recordReset, 1, "meta", nil),
+		encodeWrite(1, "test.diskqueue.000000.dat", 0, make([]byte, replicaChunkSize+1)),
+	} {
+		primaryConn, followerConn := net.Pipe()
+		f := NewFollower(tmpDir, followerConn, l)
+		go func(rec []byte) {
+			primaryConn.Write(rec)
+			primaryConn.Close()
+		}(rec)
+		NotNil(t, f.Wait())
+	}
+}
+
+func TestReplicationLargeMessage(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_replication_large_message" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	primaryDir := filepath.Join(tmpDir, "primary")
+	followerDir := filepath.Join(tmpDir, "follower")
+	Nil(t, os.Mkdir(primaryDir, 0755))
+	Nil(t, os.Mkdir(followerDir, 0755))
+
+	dq := NewWithOptions(dqName, primaryDir, Options{
+		MaxBytesPerFile: 4 << 20,
+		MinMsgSize:      0,
+		MaxMsgSize:      4 << 20,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		ReplicaAcks:     1,
+	}, l)
+	NotNil(t, dq)
+
+	primaryConn, followerConn := net.Pipe()
+	f := NewFollower(followerDir, followerConn, l)
+	Nil(t, dq.(Replicator).AddFollower(primaryConn))
+
+	// a message larger than a chunk is streamed as several writes
+	msg := make([]byte, 2*replicaChunkSize+10)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Close())
+	Nil(t, f.Wait())
+	assertSameFiles(t, primaryDir, followerDir)
+}
@@ -0,0 +1,135 @@
+package diskqueue
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"time"
+)
+
+// Scanner is implemented by queues that can list the messages they hold
+// without consuming them
+type Scanner interface {
+	// Scan calls fn with every message from the read position up to the
+	// write position at the time of the call, in order, until fn returns
+	// false. msg is only valid until fn returns
+	Scan(fn func(pos Position, msg []byte) bool) error
+}
+
+// Position is where a message is stored
+type Position struct {
+	FileNum int64 // number of the data file, see fileName
+	Offset  int64 // byte offset of the message in the file
+}
+
+// scanSegment is the part of a data file that holds pending messages
+type scanSegment struct {
+	fileNum int64
+	file    File
+	start   int64
+	end     int64
+}
+
+// scanSnapshot holds the data files opened by openScan
+type scanSnapshot struct {
+	segments []scanSegment
+	err      error
+}
+
+// Scan calls fn with every pending message, in order, until fn returns false
+//
+// the read position is left untouched. Messages put (or delayed messages
+// that became due) after Scan was called are not visited, while the ones
+// read in the meantime still are. Delayed messages that are not due yet are
+// not visited either, nor are messages that expired through MaxMsgAge or a
+// TTL
+func (d *diskQueue) Scan(fn func(pos Position, msg []byte) bool) error {
+	return d.scan(func(pos Position, f frame) bool {
+		return fn(pos, f.data)
+	})
+}
+
+// scan is Scan with the decoded frames, which are released once fn returns,
+// leaving out the ones that expired by the time it was called
+func (d *diskQueue) scan(fn func(pos Position, f frame) bool) error {
+	now := time.Now().UnixNano()
+
+	d.RLock()
+	if d.state != stateOpen {
+		d.RUnlock()
+		return ErrClosed
+	}
+	d.scanChan <- 1
+	snapshot := <-d.scanResponseChan
+	d.RUnlock()
+
+	defer func() {
+		for _, seg := range snapshot.segments {
+			seg.file.Close()
+		}
+	}()
+	if snapshot.err != nil {
+		return snapshot.err
+	}
+
+	// the files were opened by ioLoop, so they remain readable even if they
+	// are consumed and removed while they are scanned
+	for _, seg := range snapshot.segments {
+		reader := bufio.NewReader(io.NewSectionReader(seg.file, seg.start, seg.end-seg.start))
+		pos := seg.start
+		for pos < seg.end {
+			f, totalBytes, err := d.readFrame(reader)
+			if err != nil {
+				return err
+			}
+			more := true
+			deadline := d.deadline(f)
+			if deadline == 0 || now <= deadline {
+				more = fn(Position{FileNum: seg.fileNum, Offset: pos}, f)
+			}
+			d.releaseFrame(f)
+			if !more {
+				return nil
+			}
+			pos += totalBytes
+		}
+	}
+
+	return nil
+}
+
+// openScan opens the data files from the read position up to the write
+// position, called by ioLoop so that they are consistent with each other
+func (d *diskQueue) openScan() scanSnapshot {
+	var snapshot scanSnapshot
+
+	for fileNum := d.readFileNum; fileNum <= d.writeFileNum; fileNum++ {
+		start := int64(0)
+		if fileNum == d.readFileNum {
+			start = d.readPos
+		}
+		if fileNum == d.writeFileNum && start >= d.writePos {
+			break
+		}
+
+		f, err := d.fs.OpenFile(d.fileName(fileNum), os.O_RDONLY, 0600)
+		if err != nil {
+			snapshot.err = err
+			return snapshot
+		}
+		snapshot.segments = append(snapshot.segments, scanSegment{fileNum: fileNum, file: f, start: start})
+		seg := &snapshot.segments[len(snapshot.segments)-1]
+
+		if fileNum == d.writeFileNum {
+			seg.end = d.writePos
+		} else {
+			seg.end, err = d.dataEnd(f)
+			if err != nil {
+				snapshot.err = err
+				return snapshot
+			}
+		}
+	}
+
+	return snapshot
+}
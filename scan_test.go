@@ -0,0 +1,130 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueScan(t *testing.T) {
+	for _, diskLimit := range []int64{0, 1 << 20} {
+		t.Run(fmt.Sprintf("diskLimit=%d", diskLimit), func(t *testing.T) {
+			l := NewTestLogger(t)
+			dqName := "test_disk_queue_scan" + strconv.Itoa(int(time.Now().Unix()))
+			tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+			if err != nil {
+				panic(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			dq := NewWithDiskSpace(dqName, tmpDir, diskLimit, 100, 0, 1<<10, 2500, 2*time.Second, l)
+			NotNil(t, dq)
+
+			for i := 0; i < 100; i++ {
+				Nil(t, dq.Put([]byte(strconv.Itoa(i))))
+			}
+			for i := 0; i < 10; i++ {
+				Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+			}
+
+			var msgs []string
+			var last Position
+			Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+				Equal(t, true, pos.FileNum > last.FileNum || (pos.FileNum == last.FileNum && pos.Offset >= last.Offset))
+				last = pos
+				msgs = append(msgs, string(msg))
+				return true
+			}))
+			Equal(t, 90, len(msgs))
+			for i, msg := range msgs {
+				Equal(t, strconv.Itoa(i+10), msg)
+			}
+			Equal(t, true, last.FileNum > 0)
+			// nothing was consumed
+			Equal(t, int64(90), dq.Depth())
+			Equal(t, []byte("10"), <-dq.PeekChan())
+
+			// stops when fn returns false
+			msgs = nil
+			Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+				msgs = append(msgs, string(msg))
+				return len(msgs) < 3
+			}))
+			Equal(t, []string{"10", "11", "12"}, msgs)
+
+			// messages written or read during the scan do not change what it sees
+			msgs = nil
+			Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+				if len(msgs) == 0 {
+					Nil(t, dq.Put([]byte("new")))
+					for i := 10; i < 100; i++ {
+						Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+					}
+				}
+				msgs = append(msgs, string(msg))
+				return true
+			}))
+			Equal(t, 90, len(msgs))
+			Equal(t, "99", msgs[89])
+
+			msgs = nil
+			Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+				msgs = append(msgs, string(msg))
+				return true
+			}))
+			Equal(t, []string{"new"}, msgs)
+
+			Nil(t, dq.Empty())
+			Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+				t.Fatal("scanned an empty queue")
+				return true
+			}))
+			dq.Close()
+			NotNil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool { return true }))
+		})
+	}
+}
+
+func TestDiskQueueScanExpired(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_scan_expired" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := NewWithOptions(dqName, tmpDir, Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxMsgAge:       200 * time.Millisecond,
+	}, l)
+	NotNil(t, dq)
+	defer dq.Close()
+
+	Nil(t, dq.Put([]byte("aged")))
+	Nil(t, dq.(TTLPutter).PutWithTTL([]byte("ttl"), 50*time.Millisecond))
+	Nil(t, dq.Put([]byte("fresh")))
+	time.Sleep(100 * time.Millisecond)
+	Nil(t, dq.Put([]byte("new")))
+
+	// expired messages are skipped even before a read dropped them
+	var msgs []string
+	Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+		msgs = append(msgs, string(msg))
+		return true
+	}))
+	Equal(t, []string{"aged", "fresh", "new"}, msgs)
+
+	time.Sleep(150 * time.Millisecond)
+	msgs = nil
+	Nil(t, dq.(Scanner).Scan(func(pos Position, msg []byte) bool {
+		msgs = append(msgs, string(msg))
+		return true
+	}))
+	Equal(t, []string{"new"}, msgs)
+}
@@ -0,0 +1,421 @@
+package diskqueue
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedQueue spreads messages over several diskQueues, each with its own
+// ioLoop and fsyncs, stored in subdirectories of dataPath
+//
+// messages put with the same key always go to the same shard, so they are
+// read in the order they were put. Messages without a key are spread round
+// robin and are not ordered relative to each other
+type ShardedQueue struct {
+	// 64bit atomic vars need to be first for proper alignment on 32bit platforms
+	nextShard uint64
+	usage     int64 // disk space used by every shard, see publishUsage()
+	reserved  int64 // by the puts in progress, on top of usage
+
+	sync.RWMutex
+
+	name              string
+	shards            []*diskQueue
+	maxBytesDiskSpace int64
+	exitFlag          int32
+
+	logf AppLogFunc
+
+	// exposed via ReadChan(), fed by one forwarder per shard once started
+	readChan       chan []byte
+	forwarding     bool
+	forwardExit    chan int
+	forwardWaitGrp sync.WaitGroup
+
+	// exposed via Done()
+	doneChan chan struct{}
+}
+
+// NewSharded instantiates a ShardedQueue with numShards shards stored in
+// dataPath as the diskQueues <name>.s0/<name>.s0, <name>.s1/<name>.s1, ...
+//
+// numShards must not change while the shards hold data, as keys would map to
+// other shards. opts.MaxBytesDiskSpace is the budget shared by every shard,
+// once it is reached the oldest file of the shard using the most space is
+// evicted first
+func NewSharded(name string, dataPath string, numShards int,
+	opts Options, logf AppLogFunc) (*ShardedQueue, error) {
+
+	if numShards <= 0 {
+		return nil, fmt.Errorf("invalid number of shards (%d)", numShards)
+	}
+
+	// every shard needs room for its metadata file, on top of the one data file
+	// with max size that diskQueue itself checks for
+	if opts.MaxBytesDiskSpace > 0 &&
+		opts.MaxBytesDiskSpace <= int64(numShards)*maxMetaDataFileSize+opts.MaxBytesPerFile {
+		return nil, fmt.Errorf(
+			"disk size limit too small(%d): not enough space for %d MetaData files (size=%d) and at least one data file with max size (maxBytesPerFile=%d)",
+			opts.MaxBytesDiskSpace, numShards, maxMetaDataFileSize, opts.MaxBytesPerFile)
+	}
+
+	sq := &ShardedQueue{
+		name:              name,
+		maxBytesDiskSpace: opts.MaxBytesDiskSpace,
+		logf:              logf,
+		readChan:          make(chan []byte),
+		doneChan:          make(chan struct{}),
+	}
+	if opts.MaxBytesDiskSpace > 0 {
+		opts.sharedUsage = &sq.usage
+	}
+
+	fs := opts.FS
+	if fs == nil {
+		fs = OSFS{}
+	}
+	for i := 0; i < numShards; i++ {
+		shardPath := filepath.Join(dataPath, sq.shardName(i))
+		err := fs.MkdirAll(shardPath, 0755)
+		if err == nil {
+			shard := NewWithOptions(sq.shardName(i), shardPath, opts, logf)
+			if shard != nil {
+				sq.shards = append(sq.shards, shard.(*diskQueue))
+				continue
+			}
+			err = errors.New("failed to start diskqueue")
+		}
+
+		for _, dq := range sq.shards {
+			dq.Close()
+		}
+		return nil, fmt.Errorf("failed to create shard %d - %s", i, err)
+	}
+
+	return sq, nil
+}
+
+func (sq *ShardedQueue) shardName(shard int) string {
+	return fmt.Sprintf("%s.s%d", sq.name, shard)
+}
+
+// NumShards returns the number of shards
+func (sq *ShardedQueue) NumShards() int {
+	return len(sq.shards)
+}
+
+// ShardFor returns the shard that messages put with key are written to
+func (sq *ShardedQueue) ShardFor(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(sq.shards)))
+}
+
+// Put writes a []byte to the shard of key, or to the next shard in round
+// robin order when key is nil
+//
+// puts to different shards run concurrently, a disk space limit shared by
+// the shards only makes them wait for each other once it is reached. A put
+// that waits for room in its shard (FullBlock) does not hold up the others,
+// nor Close()
+func (sq *ShardedQueue) Put(key []byte, data []byte) error {
+	if atomic.LoadInt32(&sq.exitFlag) == 1 {
+		return ErrClosed
+	}
+
+	var shard int
+	if key == nil {
+		shard = int((atomic.AddUint64(&sq.nextShard, 1) - 1) % uint64(len(sq.shards)))
+	} else {
+		shard = sq.ShardFor(key)
+	}
+
+	if sq.maxBytesDiskSpace > 0 {
+		expectedBytesIncrease := int64(4+len(data)) + numFileMsgBytes
+		err := sq.reserve(expectedBytesIncrease)
+		if err != nil {
+			return err
+		}
+		// the shard accounts for the message once it was written
+		defer atomic.AddInt64(&sq.reserved, -expectedBytesIncrease)
+	}
+
+	// a closed shard returns ErrClosed
+	return sq.shards[shard].Put(data)
+}
+
+// reserve holds expectedBytesIncrease of the shared budget for a put, and
+// frees up disk space when it does not fit
+//
+// the shards add what they use to usage as they write, evict and remove
+// files, so a put that fits only touches atomics
+func (sq *ShardedQueue) reserve(expectedBytesIncrease int64) error {
+	if expectedBytesIncrease > sq.maxBytesDiskSpace {
+		return fmt.Errorf("%w: message size(%d) surpasses disk size limit(%d)",
+			ErrMsgSize, expectedBytesIncrease, sq.maxBytesDiskSpace)
+	}
+
+	reserved := atomic.AddInt64(&sq.reserved, expectedBytesIncrease)
+	if atomic.LoadInt64(&sq.usage)+reserved <= sq.maxBytesDiskSpace {
+		return nil
+	}
+
+	// one put at a time frees up space
+	sq.Lock()
+	err := ErrClosed
+	if sq.exitFlag == 0 {
+		err = sq.freeDiskSpace(expectedBytesIncrease)
+	}
+	sq.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&sq.reserved, -expectedBytesIncrease)
+	}
+	return err
+}
+
+// freeDiskSpace evicts the oldest files of the shards using the most space
+// until the reserved bytes fit within the shared budget
+func (sq *ShardedQueue) freeDiskSpace(expectedBytesIncrease int64) error {
+	exhausted := make([]bool, len(sq.shards))
+	for {
+		if atomic.LoadInt64(&sq.usage)+atomic.LoadInt64(&sq.reserved) <= sq.maxBytesDiskSpace {
+			return nil
+		}
+
+		largest := -1
+		var largestUsage int64
+		for i, dq := range sq.shards {
+			usage := <-dq.usageChan
+			if !exhausted[i] && (largest < 0 || usage > largestUsage) {
+				largest = i
+				largestUsage = usage
+			}
+		}
+		if largest < 0 {
+			break
+		}
+
+		sq.shards[largest].evictChan <- 1
+		err := <-sq.shards[largest].evictResponseChan
+		if err != nil {
+			// nothing left to evict in this shard
+			exhausted[largest] = true
+			continue
+		}
+
+		sq.logf(INFO, "SHARDEDQUEUE(%s) evicted a file of shard %d to free up disk space", sq.name, largest)
+	}
+
+	return fmt.Errorf("%w: could not make space for expectedBytesIncrease = %d, with maxBytesDiskSpace = %d",
+		ErrDiskFull, expectedBytesIncrease, sq.maxBytesDiskSpace)
+}
+
+// ReadChan returns the receive-only []byte channel for reading data from
+// every shard, in order for each key. It is closed by Close() and Delete()
+//
+// it must not be used along with ShardReadChan()
+func (sq *ShardedQueue) ReadChan() <-chan []byte {
+	sq.Lock()
+	defer sq.Unlock()
+
+	if !sq.forwarding && sq.exitFlag == 0 {
+		sq.forwarding = true
+		sq.startForwarders()
+	}
+
+	return sq.readChan
+}
+
+// ShardReadChan returns the receive-only []byte channel for reading data
+// from a single shard, so that each shard can have its own consumer
+//
+// it must not be used along with ReadChan()
+func (sq *ShardedQueue) ShardReadChan(shard int) <-chan []byte {
+	return sq.shards[shard].ReadChan()
+}
+
+func (sq *ShardedQueue) startForwarders() {
+	sq.forwardExit = make(chan int)
+	for _, dq := range sq.shards {
+		sq.forwardWaitGrp.Add(1)
+		go sq.forward(dq, sq.forwardExit)
+	}
+}
+
+// stopForwarders waits for the forwarders to exit, the messages they
+// offered stay in their shard
+func (sq *ShardedQueue) stopForwarders() {
+	if !sq.forwarding {
+		return
+	}
+	close(sq.forwardExit)
+	sq.forwardWaitGrp.Wait()
+}
+
+// forward feeds ReadChan() from a shard
+//
+// it peeks at the head of the shard and only takes it (i.e. removes it from
+// disk) once a consumer received it, so that nothing is lost when it exits.
+// It is taken by its position, so a head that expired or was evicted in the
+// meantime is not mistaken for the message that followed it
+func (sq *ShardedQueue) forward(dq *diskQueue, exitChan chan int) {
+	defer sq.forwardWaitGrp.Done()
+
+	for {
+		var h head
+		select {
+		case h = <-dq.headChan:
+		case <-exitChan:
+			return
+		}
+
+		select {
+		case sq.readChan <- h.data:
+			err := dq.take(h.pos)
+			if err != nil {
+				sq.logf(ERROR, "SHARDEDQUEUE(%s) failed to consume message of %s - %s", sq.name, dq.name, err)
+			}
+		case <-exitChan:
+			return
+		}
+	}
+}
+
+// Depth returns the depth of every shard combined
+//
+// a message received from ReadChan() is counted until its forwarder removed
+// it from its shard, which happens right after it was received
+func (sq *ShardedQueue) Depth() int64 {
+	var depth int64
+	for _, dq := range sq.shards {
+		depth += dq.Depth()
+	}
+	return depth
+}
+
+// ShardDepth returns the depth of a single shard
+func (sq *ShardedQueue) ShardDepth(shard int) int64 {
+	return sq.shards[shard].Depth()
+}
+
+// TotalBytesFolderSize returns the size of every shard's files combined
+func (sq *ShardedQueue) TotalBytesFolderSize() int64 {
+	var size int64
+	for _, dq := range sq.shards {
+		size += dq.TotalBytesFolderSize()
+	}
+	return size
+}
+
+// Empty destructively clears out any pending data in every shard
+func (sq *ShardedQueue) Empty() error {
+	sq.Lock()
+	defer sq.Unlock()
+
+	if sq.exitFlag == 1 {
+		return ErrClosed
+	}
+
+	sq.logf(INFO, "SHARDEDQUEUE(%s): emptying", sq.name)
+
+	// the forwarders would offer messages that no longer exist
+	sq.stopForwarders()
+
+	var err error
+	for _, dq := range sq.shards {
+		innerErr := dq.Empty()
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+
+	if sq.forwarding {
+		sq.startForwarders()
+	}
+
+	return err
+}
+
+// Close cleans up every shard and persists their metadata
+func (sq *ShardedQueue) Close() error {
+	return sq.exit(false)
+}
+
+// Delete cleans up every shard without persisting their metadata
+func (sq *ShardedQueue) Delete() error {
+	return sq.exit(true)
+}
+
+func (sq *ShardedQueue) exit(deleted bool) error {
+	sq.Lock()
+	defer sq.Unlock()
+
+	if sq.exitFlag == 1 {
+		return nil
+	}
+	atomic.StoreInt32(&sq.exitFlag, 1)
+
+	sq.logf(INFO, "SHARDEDQUEUE(%s): closing", sq.name)
+
+	sq.stopForwarders()
+	sq.forwarding = false
+	// tells readers that nothing is coming anymore
+	close(sq.readChan)
+
+	var err error
+	for _, dq := range sq.shards {
+		var innerErr error
+		if deleted {
+			innerErr = dq.Delete()
+		} else {
+			innerErr = dq.Close()
+		}
+		if innerErr != nil {
+			err = innerErr
+		}
+	}
+	close(sq.doneChan)
+
+	return err
+}
+
+// Done returns a channel that is closed once every shard was closed, along
+// with ReadChan()
+func (sq *ShardedQueue) Done() <-chan struct{} {
+	return sq.doneChan
+}
+
+// Destroy deletes the queue, unless it was already closed, and removes the
+// files and subdirectory of every shard
+func (sq *ShardedQueue) Destroy() error {
+	sq.Delete()
+	// a Close() running along may still be closing the shards
+	<-sq.doneChan
+
+	var err error
+	for _, dq := range sq.shards {
+		innerErr := dq.Destroy()
+		if innerErr != nil {
+			err = innerErr
+			continue
+		}
+		// the subdirectory of the shard is left behind if it holds other files
+		dq.fs.Remove(dq.dataPath)
+	}
+	return err
+}
+
+// publishUsage adds what totalDiskSpaceUsed changed by since it was last
+// called to the usage shared with the other queues of the budget, if any
+func (d *diskQueue) publishUsage() {
+	if d.sharedUsage == nil || d.totalDiskSpaceUsed == d.publishedUsage {
+		return
+	}
+	atomic.AddInt64(d.sharedUsage, d.totalDiskSpaceUsed-d.publishedUsage)
+	d.publishedUsage = d.totalDiskSpaceUsed
+}
@@ -0,0 +1,319 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShardedQueue(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	opts := Options{
+		MaxBytesPerFile: 100,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+	}
+	sq, err := NewSharded(sqName, tmpDir, 4, opts, l)
+	Nil(t, err)
+	NotNil(t, sq)
+	Equal(t, 4, sq.NumShards())
+
+	for i := 0; i < 4; i++ {
+		_, err := os.Stat(filepath.Join(tmpDir, sqName+".s"+strconv.Itoa(i)))
+		Nil(t, err)
+	}
+
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i := 0; i < 20; i++ {
+		for _, key := range keys {
+			Nil(t, sq.Put([]byte(key), []byte(key+strconv.Itoa(i))))
+		}
+	}
+	Equal(t, int64(120), sq.Depth())
+	for _, key := range keys {
+		Equal(t, true, sq.ShardDepth(sq.ShardFor([]byte(key))) >= 20)
+	}
+
+	// messages of each key are read in order
+	next := make(map[string]int)
+	for i := 0; i < 120; i++ {
+		msg := <-sq.ReadChan()
+		key := string(msg[:1])
+		Equal(t, key+strconv.Itoa(next[key]), string(msg))
+		next[key]++
+	}
+
+	// messages without a key are spread round robin
+	for i := 0; i < 8; i++ {
+		Nil(t, sq.Put(nil, []byte{byte(i)}))
+	}
+	Nil(t, sq.Close())
+	for i := 0; i < 4; i++ {
+		Equal(t, int64(2), sq.ShardDepth(i))
+	}
+	NotNil(t, sq.Put(nil, []byte{0}))
+
+	// shards persist across restarts
+	sq, err = NewSharded(sqName, tmpDir, 4, opts, l)
+	Nil(t, err)
+	Equal(t, int64(8), sq.Depth())
+	received := make(map[byte]bool)
+	for i := 0; i < 8; i++ {
+		msg := <-sq.ReadChan()
+		received[msg[0]] = true
+	}
+	Equal(t, 8, len(received))
+
+	Nil(t, sq.Put([]byte("a"), []byte("a")))
+	Nil(t, sq.Empty())
+	Equal(t, int64(0), sq.Depth())
+	Nil(t, sq.Put([]byte("b"), []byte("b")))
+	Equal(t, []byte("b"), <-sq.ReadChan())
+	sq.Close()
+
+	_, err = NewSharded(sqName, tmpDir, 0, opts, l)
+	NotNil(t, err)
+}
+
+func TestShardedQueueShardReadChan(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue_shard_read_chan" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sq, err := NewSharded(sqName, tmpDir, 3, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+	}, l)
+	Nil(t, err)
+	defer sq.Close()
+
+	for i := 0; i < 30; i++ {
+		key := []byte(strconv.Itoa(i % 5))
+		Nil(t, sq.Put(key, []byte(strconv.Itoa(i))))
+	}
+
+	// each shard is consumed on its own, in the order it was written to
+	for shard := 0; shard < 3; shard++ {
+		for i := 0; i < 30; i++ {
+			if sq.ShardFor([]byte(strconv.Itoa(i%5))) != shard {
+				continue
+			}
+			Equal(t, []byte(strconv.Itoa(i)), <-sq.ShardReadChan(shard))
+		}
+		Equal(t, int64(0), sq.ShardDepth(shard))
+	}
+	Equal(t, int64(0), sq.Depth())
+}
+
+func TestShardedQueueDiskSizeLimit(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue_disk_size_limit" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sq, err := NewSharded(sqName, tmpDir, 2, Options{
+		MaxBytesDiskSpace: 500,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+	}, l)
+	Nil(t, err)
+	defer sq.Close()
+
+	// a key for each shard
+	var keys [2][]byte
+	for i := 0; keys[0] == nil || keys[1] == nil; i++ {
+		key := []byte(strconv.Itoa(i))
+		keys[sq.ShardFor(key)] = key
+	}
+
+	// 14 bytes per message, 7 messages and their count (106 bytes) per file,
+	// the 2 metadata files take up 112 bytes
+	msg := make([]byte, 10)
+	for i := 0; i < 24; i++ {
+		Nil(t, sq.Put(keys[1], msg))
+	}
+	Equal(t, int64(24), sq.Depth())
+
+	// room is made by evicting the oldest file of the largest shard
+	for i := 0; i < 6; i++ {
+		Nil(t, sq.Put(keys[0], msg))
+	}
+	Equal(t, int64(6), sq.ShardDepth(0))
+	Equal(t, int64(17), sq.ShardDepth(1))
+	assertFileNotExist(t, sq.shards[1].fileName(0))
+
+	// puts that fit do not wait for each other, and the shared usage keeps
+	// up with the shards
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		go func(key []byte) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				Nil(t, sq.Put(key, msg))
+			}
+		}(key)
+	}
+	wg.Wait()
+	var usage int64
+	for _, dq := range sq.shards {
+		usage += <-dq.usageChan
+	}
+	Equal(t, usage, atomic.LoadInt64(&sq.usage))
+	Equal(t, int64(0), atomic.LoadInt64(&sq.reserved))
+	Equal(t, true, usage <= 500)
+}
+
+func TestShardedQueueEvictOffered(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue_evict_offered" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sq, err := NewSharded(sqName, tmpDir, 1, Options{
+		MaxBytesDiskSpace: 500,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+	}, l)
+	Nil(t, err)
+
+	// 7 messages per file
+	for i := 0; i < 8; i++ {
+		Nil(t, sq.Put(nil, []byte{byte(i), 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+	}
+	readChan := sq.ReadChan()
+	time.Sleep(20 * time.Millisecond)
+
+	// the file of the message being offered is evicted before it is received
+	sq.shards[0].evictChan <- 1
+	Nil(t, <-sq.shards[0].evictResponseChan)
+	Equal(t, byte(0), (<-readChan)[0])
+
+	// which does not consume the message that followed it
+	select {
+	case msg := <-readChan:
+		Equal(t, byte(7), msg[0])
+	case <-time.After(time.Second):
+		t.Fatal("message following the evicted one was lost")
+	}
+	// it is taken from the shard right after it was received
+	for i := 0; i < 100 && sq.Depth() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	Equal(t, int64(0), sq.Depth())
+
+	Nil(t, sq.Close())
+	_, ok := <-readChan
+	Equal(t, false, ok)
+	Nil(t, sq.Close())
+}
+
+func TestShardedQueueFS(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue_fs" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	opts := Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		FS:              ffs,
+	}
+
+	// the subdirectories of the shards are created through the FS
+	ffs.Inject(Fault{Op: OpMkdir, Path: sqName + ".s1", Err: syscall.EACCES})
+	_, err = NewSharded(sqName, tmpDir, 2, opts, l)
+	NotNil(t, err)
+	Equal(t, 1, ffs.Injected())
+
+	ffs.Clear()
+	sq, err := NewSharded(sqName, tmpDir, 2, opts, l)
+	Nil(t, err)
+	Nil(t, sq.Put(nil, []byte("abc")))
+	Equal(t, []byte("abc"), <-sq.ReadChan())
+	Nil(t, sq.Close())
+}
+
+func TestShardedQueueFullBlockClose(t *testing.T) {
+	l := NewTestLogger(t)
+	sqName := "test_sharded_queue_full_block_close" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	sq, err := NewSharded(sqName, tmpDir, 2, Options{
+		MaxBytesPerFile: 1024,
+		MinMsgSize:      0,
+		MaxMsgSize:      1 << 10,
+		SyncEvery:       2500,
+		SyncTimeout:     2 * time.Second,
+		MaxDepth:        1,
+		FullPolicy:      FullBlock,
+	}, l)
+	Nil(t, err)
+
+	key := []byte("key")
+	Nil(t, sq.Put(key, []byte("first")))
+	putErrChan := make(chan error)
+	go func() {
+		putErrChan <- sq.Put(key, []byte("blocked"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the blocked put does not keep the other shard or Close() waiting
+	other := []byte("other")
+	for sq.ShardFor(other) == sq.ShardFor(key) {
+		other = append(other, '_')
+	}
+	Nil(t, sq.Put(other, []byte("other")))
+
+	closeErrChan := make(chan error)
+	go func() {
+		closeErrChan <- sq.Close()
+	}()
+	select {
+	case err := <-closeErrChan:
+		Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() waited for a blocked put")
+	}
+	Equal(t, ErrClosed, <-putErrChan)
+}
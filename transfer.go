@@ -0,0 +1,324 @@
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// TransformFunc turns a message read from the source of a Transferrer into
+// the message written to its destination
+type TransformFunc func(data []byte) ([]byte, error)
+
+// Transferrer moves messages from one Diskqueue to another, so that a crash
+// neither loses nor duplicates a message that was being moved
+//
+// each move is recorded in a journal before the message is appended to the
+// destination, which holds where the message was read from in the source and
+// where it is written to in the destination. A move that the journal shows
+// was interrupted is completed before the next one starts
+type Transferrer struct {
+	sync.Mutex
+
+	src             *diskQueue
+	dst             *diskQueue
+	journalFileName string
+	transform       TransformFunc
+
+	logf AppLogFunc
+}
+
+// transferAppend asks the destination to append data, see appendJournaled
+type transferAppend struct {
+	journalFileName string
+	srcPos          Position
+	data            []byte
+	recovering      bool // the journal was left by an interrupted move
+}
+
+// transferJournal is what the journal holds: the source and destination
+// positions as big endian int64s, followed by the message
+type transferJournal struct {
+	srcPos Position
+	dstPos Position
+	data   []byte
+}
+
+// NewTransferrer moves messages from src to dst through transform, which
+// can be nil to move them unchanged, recording moves in the journal file
+// journalFileName
+//
+// src and dst must be created by this package, and the Transferrer must be
+// the only reader of src. A move interrupted by a crash is completed right
+// away
+func NewTransferrer(src Interface, dst Interface, journalFileName string, transform TransformFunc, logf AppLogFunc) (*Transferrer, error) {
+	srcQueue, ok := src.(*diskQueue)
+	if !ok {
+		return nil, errors.New("source is not a Diskqueue")
+	}
+	dstQueue, ok := dst.(*diskQueue)
+	if !ok {
+		return nil, errors.New("destination is not a Diskqueue")
+	}
+
+	t := Transferrer{
+		src:             srcQueue,
+		dst:             dstQueue,
+		journalFileName: journalFileName,
+		transform:       transform,
+		logf:            logf,
+	}
+
+	err := t.recover()
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Transfer moves the message at the head of the source to the destination,
+// waiting for one until ctx is done
+//
+// when transform fails, the message stays in the source and the error is
+// returned
+func (t *Transferrer) Transfer(ctx context.Context) error {
+	t.Lock()
+	defer t.Unlock()
+
+	err := t.recover()
+	if err != nil {
+		return err
+	}
+
+	_, err = t.src.Peek(ctx)
+	if err != nil {
+		return err
+	}
+
+	var srcPos Position
+	var data []byte
+	now := time.Now().UnixNano()
+	err = t.src.scan(func(pos Position, f frame) bool {
+		deadline := t.src.deadline(f)
+		if deadline != 0 && now > deadline {
+			// dropped by the source rather than read
+			return true
+		}
+		srcPos = pos
+		data = make([]byte, len(f.data))
+		copy(data, f.data)
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return errors.New("no message to transfer")
+	}
+
+	if t.transform != nil {
+		data, err = t.transform(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.move(transferAppend{journalFileName: t.journalFileName, srcPos: srcPos, data: data})
+}
+
+// recover completes the move recorded in the journal, if any
+func (t *Transferrer) recover() error {
+	j, err := readTransferJournal(t.dst.fs, t.journalFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	t.logf(INFO, "TRANSFER: completing move from %d of %s", j.srcPos.Offset, t.src.fileName(j.srcPos.FileNum))
+	return t.move(transferAppend{
+		journalFileName: t.journalFileName,
+		srcPos:          j.srcPos,
+		data:            j.data,
+		recovering:      true,
+	})
+}
+
+// move appends to the destination, consumes the message from the source
+// and then forgets about the move
+func (t *Transferrer) move(req transferAppend) error {
+	err := t.dst.request(func() {
+		t.dst.appendChan <- req
+	}, t.dst.appendResponseChan)
+	if err != nil {
+		return err
+	}
+
+	err = t.src.request(func() {
+		t.src.skipChan <- req.srcPos
+	}, t.src.skipResponseChan)
+	if err != nil {
+		return err
+	}
+
+	return t.dst.fs.Remove(t.journalFileName)
+}
+
+// request sends a request to ioLoop through send and returns its response
+func (d *diskQueue) request(send func(), responseChan chan error) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.state != stateOpen {
+		return ErrClosed
+	}
+
+	send()
+	return <-responseChan
+}
+
+// appendJournaled records req in its journal along with the write position
+// and appends its message there, unless the journal shows that it already
+// was
+func (d *diskQueue) appendJournaled(req transferAppend) error {
+	if req.recovering {
+		j, err := readTransferJournal(d.fs, req.journalFileName)
+		if err != nil {
+			return err
+		}
+		if d.holdsJournaled(j) {
+			return nil
+		}
+	}
+
+	err := d.checkDepth(1)
+	if err != nil {
+		return err
+	}
+
+	j := transferJournal{
+		srcPos: req.srcPos,
+		dstPos: Position{FileNum: d.writeFileNum, Offset: d.writePos},
+		data:   req.data,
+	}
+	err = writeTransferJournal(d.fs, req.journalFileName, j)
+	if err != nil {
+		return err
+	}
+
+	err = d.writeOne(frame{data: req.data})
+	if err != nil {
+		d.fs.Remove(req.journalFileName)
+		return err
+	}
+
+	return d.sync()
+}
+
+// holdsJournaled returns whether the message of j was appended, i.e. the
+// write position moved past where it was to be written and the message is
+// found there, unless it was already consumed along with its file
+func (d *diskQueue) holdsJournaled(j transferJournal) bool {
+	if d.writeFileNum < j.dstPos.FileNum ||
+		(d.writeFileNum == j.dstPos.FileNum && d.writePos <= j.dstPos.Offset) {
+		return false
+	}
+
+	f, err := d.fs.OpenFile(d.fileName(j.dstPos.FileNum), os.O_RDONLY, 0600)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	fr, _, err := d.readFrame(bufio.NewReader(io.NewSectionReader(f, j.dstPos.Offset, 1<<62)))
+	if err != nil {
+		return false
+	}
+	defer d.releaseFrame(fr)
+	return bytes.Equal(fr.data, j.data)
+}
+
+// skipAt consumes the message at pos and persists that it was, called by
+// ioLoop while the message at the read position is ready to be handed out
+// (ready), if there is any
+func (d *diskQueue) skipAt(pos Position, ready bool) error {
+	err := d.consumeAt(pos, ready)
+	if err != nil {
+		return err
+	}
+	return d.sync()
+}
+
+// consumeAt moves the read position past the message at pos, unless it was
+// already consumed, expired or evicted
+func (d *diskQueue) consumeAt(pos Position, ready bool) error {
+	if d.readFileNum > pos.FileNum || (d.readFileNum == pos.FileNum && d.readPos > pos.Offset) {
+		// already consumed, or dropped as it expired
+		return nil
+	}
+	if !ready || d.readFileNum != pos.FileNum || d.readPos != pos.Offset {
+		return fmt.Errorf("no message to consume at %d of %s", pos.Offset, d.fileName(pos.FileNum))
+	}
+
+	d.moveForward()
+	return nil
+}
+
+func writeTransferJournal(fs FS, fileName string, j transferJournal) error {
+	var buf bytes.Buffer
+	writeInt64(&buf, j.srcPos.FileNum)
+	writeInt64(&buf, j.srcPos.Offset)
+	writeInt64(&buf, j.dstPos.FileNum)
+	writeInt64(&buf, j.dstPos.Offset)
+	buf.Write(j.data)
+
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+	f, err := fs.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		fs.Remove(tmpFileName)
+		return err
+	}
+
+	// atomically rename
+	return fs.Rename(tmpFileName, fileName)
+}
+
+func readTransferJournal(fs FS, fileName string) (transferJournal, error) {
+	var j transferJournal
+
+	data, err := readFile(fs, fileName)
+	if err != nil {
+		return j, err
+	}
+	if len(data) < 32 {
+		return j, fmt.Errorf("invalid journal size (%d)", len(data))
+	}
+
+	j.srcPos.FileNum = int64(binary.BigEndian.Uint64(data))
+	j.srcPos.Offset = int64(binary.BigEndian.Uint64(data[8:]))
+	j.dstPos.FileNum = int64(binary.BigEndian.Uint64(data[16:]))
+	j.dstPos.Offset = int64(binary.BigEndian.Uint64(data[24:]))
+	j.data = data[32:]
+	return j, nil
+}
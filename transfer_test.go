@@ -0,0 +1,141 @@
+package diskqueue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTransferrer(t *testing.T) {
+	l := NewTestLogger(t)
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	src := New("test_transfer_src"+suffix, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	dst := New("test_transfer_dst"+suffix, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	journalFileName := filepath.Join(tmpDir, "transfer.journal")
+
+	tr, err := NewTransferrer(src, dst, journalFileName, func(data []byte) ([]byte, error) {
+		if bytes.Equal(data, []byte("bad")) {
+			return nil, errors.New("bad message")
+		}
+		return bytes.ToUpper(data), nil
+	}, l)
+	Nil(t, err)
+
+	for _, msg := range []string{"a", "b", "bad"} {
+		Nil(t, src.Put([]byte(msg)))
+	}
+	Nil(t, tr.Transfer(context.Background()))
+	Nil(t, tr.Transfer(context.Background()))
+	Equal(t, int64(1), src.Depth())
+	Equal(t, int64(2), dst.Depth())
+	Equal(t, []byte("A"), <-dst.ReadChan())
+	Equal(t, []byte("B"), <-dst.ReadChan())
+
+	// a message that fails to be transformed stays in the source
+	NotNil(t, tr.Transfer(context.Background()))
+	Equal(t, int64(1), src.Depth())
+	Equal(t, int64(0), dst.Depth())
+	Equal(t, []byte("bad"), <-src.ReadChan())
+	assertFileNotExist(t, journalFileName)
+
+	// waits for a message until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	Equal(t, context.DeadlineExceeded, tr.Transfer(ctx))
+	cancel()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		src.Put([]byte("c"))
+	}()
+	Nil(t, tr.Transfer(context.Background()))
+	Equal(t, []byte("C"), <-dst.ReadChan())
+
+	_, err = NewTransferrer(src, nil, journalFileName, nil, l)
+	NotNil(t, err)
+
+	src.Close()
+	dst.Close()
+}
+
+func TestTransferrerRecovery(t *testing.T) {
+	l := NewTestLogger(t)
+	suffix := strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	srcName := "test_transfer_recovery_src" + suffix
+	dstName := "test_transfer_recovery_dst" + suffix
+	journalFileName := filepath.Join(tmpDir, "transfer.journal")
+
+	open := func() (Interface, Interface) {
+		src := New(srcName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+		dst := New(dstName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+		return src, dst
+	}
+	journal := func(srcPos int64, dstPos int64, data string) {
+		Nil(t, writeTransferJournal(OSFS{}, journalFileName, transferJournal{
+			srcPos: Position{Offset: srcPos},
+			dstPos: Position{Offset: dstPos},
+			data:   []byte(data),
+		}))
+	}
+
+	src, dst := open()
+	for _, msg := range []string{"a", "b", "c"} {
+		Nil(t, src.Put([]byte(msg)))
+	}
+	src.Close()
+	dst.Close()
+
+	// a crash before "A" was appended
+	journal(0, 0, "A")
+	src, dst = open()
+	_, err = NewTransferrer(src, dst, journalFileName, nil, l)
+	Nil(t, err)
+	Equal(t, int64(2), src.Depth())
+	Equal(t, int64(1), dst.Depth())
+	assertFileNotExist(t, journalFileName)
+	src.Close()
+	dst.Close()
+
+	// a crash after "B" was appended, before "b" was consumed
+	journal(5, 5, "B")
+	src, dst = open()
+	Nil(t, dst.Put([]byte("B")))
+	_, err = NewTransferrer(src, dst, journalFileName, nil, l)
+	Nil(t, err)
+	Equal(t, int64(1), src.Depth())
+	Equal(t, int64(2), dst.Depth())
+	src.Close()
+	dst.Close()
+
+	// a crash after "b" was consumed, before the journal was removed
+	journal(5, 5, "B")
+	src, dst = open()
+	tr, err := NewTransferrer(src, dst, journalFileName, nil, l)
+	Nil(t, err)
+	Equal(t, int64(1), src.Depth())
+	Equal(t, int64(2), dst.Depth())
+
+	Nil(t, tr.Transfer(context.Background()))
+	Equal(t, int64(0), src.Depth())
+	for _, expected := range []string{"A", "B", "c"} {
+		Equal(t, []byte(expected), <-dst.ReadChan())
+	}
+	src.Close()
+	dst.Close()
+}
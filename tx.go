@@ -0,0 +1,506 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Transactor is implemented by queues that can write a group of messages
+// all together or not at all
+type Transactor interface {
+	Begin() (*Tx, error)
+}
+
+// Tx is a group of messages that become readable together once committed
+//
+// they are staged in a file of their own until then. Commit() makes the
+// queue record where its data ended in that file and rename it before the
+// messages are appended, so that after a crash half way the queue is reset
+// to where it was and the messages are appended again
+//
+// the staging file counts against MaxBytesDiskSpace until the transaction is
+// done
+type Tx struct {
+	sync.Mutex
+
+	d        *diskQueue
+	fileName string
+	file     File
+	writer   *bufio.Writer
+	count    int
+	size     int64 // of the staged messages, after the header
+	done     bool
+}
+
+// txHeaderSize is the size of the header reserved at the start of a staging
+// file: the write file number, write position, messages in the write file
+// and depth before the commit, followed by whether the messages were applied
+const txHeaderSize = 5 * 8
+
+// txHeader is the write state of the queue before a transaction was applied
+type txHeader struct {
+	writeFileNum  int64
+	writePos      int64
+	writeMessages int64
+	depth         int64
+	applied       int64
+}
+
+// Begin starts a transaction, its messages are only written to the queue by
+// Commit()
+func (d *diskQueue) Begin() (*Tx, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.state != stateOpen {
+		return nil, ErrClosed
+	}
+
+	if d.enableDiskLimitation {
+		d.stageChan <- txHeaderSize
+		err := <-d.stageResponseChan
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fileName := fmt.Sprintf(path.Join(d.dataPath, "%s.diskqueue.tx.%d.dat"), d.name, rand.Int())
+	f, err := d.fs.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		if d.enableDiskLimitation {
+			d.stageChan <- -txHeaderSize
+			<-d.stageResponseChan
+		}
+		return nil, err
+	}
+
+	tx := &Tx{
+		d:        d,
+		fileName: fileName,
+		file:     f,
+		writer:   bufio.NewWriter(f),
+	}
+	// the header is filled in by Commit()
+	_, err = tx.writer.Write(make([]byte, txHeaderSize))
+	if err != nil {
+		// d is read locked, so the staged bytes cannot be released through
+		// discard() while holding it
+		tx.file.Close()
+		d.fs.Remove(tx.fileName)
+		if d.enableDiskLimitation {
+			d.stageChan <- -txHeaderSize
+			<-d.stageResponseChan
+		}
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// Put stages data in the transaction
+func (tx *Tx) Put(data []byte) error {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.done {
+		return errors.New("transaction is done")
+	}
+
+	dataLen := int32(len(data))
+	if dataLen < tx.d.minMsgSize || dataLen > tx.d.maxMsgSize {
+		return fmt.Errorf("%w (%d) minMsgSize=%d maxMsgSize=%d", ErrMsgSize, dataLen, tx.d.minMsgSize, tx.d.maxMsgSize)
+	}
+
+	if tx.d.enableDiskLimitation {
+		err := tx.d.request(func() {
+			tx.d.stageChan <- int64(4 + dataLen)
+		}, tx.d.stageResponseChan)
+		if err != nil {
+			return err
+		}
+	}
+	tx.size += int64(4 + dataLen)
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(dataLen))
+	_, err := tx.writer.Write(size[:])
+	if err == nil {
+		_, err = tx.writer.Write(data)
+	}
+	if err != nil {
+		return err
+	}
+	tx.count++
+
+	return nil
+}
+
+// Commit appends the staged messages to the queue, readers see either none
+// or all of them. The transaction is rolled back when it fails
+func (tx *Tx) Commit() error {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.done {
+		return errors.New("transaction is done")
+	}
+	tx.done = true
+
+	if tx.count == 0 {
+		tx.discard()
+		return nil
+	}
+
+	// the staged messages are durable before they can be committed
+	err := tx.writer.Flush()
+	if err == nil {
+		err = tx.file.Sync()
+	}
+	if err != nil {
+		tx.discard()
+		return err
+	}
+
+	d := tx.d
+	d.RLock()
+	if d.state != stateOpen {
+		d.RUnlock()
+		tx.discard()
+		return ErrClosed
+	}
+	d.commitChan <- tx
+	err = <-d.commitResponseChan
+	d.RUnlock()
+
+	return err
+}
+
+// Rollback drops the staged messages
+func (tx *Tx) Rollback() error {
+	tx.Lock()
+	defer tx.Unlock()
+
+	if tx.done {
+		return errors.New("transaction is done")
+	}
+	tx.done = true
+
+	return tx.discard()
+}
+
+func (tx *Tx) discard() error {
+	tx.file.Close()
+	err := tx.d.fs.Remove(tx.fileName)
+	if tx.d.enableDiskLimitation {
+		// nothing is accounted for anymore once the queue is closed
+		tx.d.request(func() {
+			tx.d.stageChan <- -(txHeaderSize + tx.size)
+		}, tx.d.stageResponseChan)
+	}
+	return err
+}
+
+// stage accounts for n more bytes staged by a transaction, making room for
+// them, or for n fewer once they are released
+func (d *diskQueue) stage(n int64) error {
+	if n > 0 {
+		err := d.checkDiskSpace(n)
+		if err != nil {
+			return err
+		}
+	}
+	d.txStaged += n
+	d.totalDiskSpaceUsed += n
+	return nil
+}
+
+// txDiskSpace returns the most disk space that appending count messages,
+// staged in size bytes, can take up
+func (d *diskQueue) txDiskSpace(count int64, size int64) int64 {
+	total := size
+	if flags := d.frameFlags(&frame{}); flags != 0 {
+		total += count * int64(frameHeaderSize(flags))
+	}
+
+	// every file the messages complete ends with its number of messages
+	files := (d.writePos+total)/(d.maxBytesPerFile-numFileMsgBytes) + 1
+	if files > count {
+		files = count
+	}
+	return total + files*numFileMsgBytes
+}
+
+// commitFileName is the name the staging file fileName is renamed to once
+// it is committed
+func commitFileName(fileName string) string {
+	return strings.TrimSuffix(fileName, ".dat") + ".commit"
+}
+
+// commitTx records the write state in the staging file of tx, renames it and
+// appends its messages, called by ioLoop so that readers do not see them
+// before they were all appended
+//
+// room is made for all of the messages before the write state is recorded,
+// as evicting messages half way would leave a rollback unable to restore it
+func (d *diskQueue) commitTx(tx *Tx) error {
+	defer tx.file.Close()
+	if d.enableDiskLimitation {
+		defer d.stage(-(txHeaderSize + tx.size))
+	}
+
+	err := d.checkDepth(int64(tx.count))
+	if err == nil && d.enableDiskLimitation {
+		err = d.checkDiskSpace(d.txDiskSpace(int64(tx.count), tx.size))
+	}
+	if err != nil {
+		d.fs.Remove(tx.fileName)
+		return err
+	}
+
+	h := txHeader{
+		writeFileNum:  d.writeFileNum,
+		writePos:      d.writePos,
+		writeMessages: d.writeMessages,
+		depth:         d.depth,
+	}
+	err = writeTxHeader(tx.file, h)
+	if err != nil {
+		d.fs.Remove(tx.fileName)
+		return err
+	}
+
+	// once renamed, the transaction is applied again after a crash
+	commitName := commitFileName(tx.fileName)
+	err = d.fs.Rename(tx.fileName, commitName)
+	if err != nil {
+		d.fs.Remove(tx.fileName)
+		return err
+	}
+
+	err = d.applyTx(tx.file)
+	if err == nil {
+		err = d.sync()
+	}
+	if err == nil {
+		h.applied = 1
+		err = writeTxHeader(tx.file, h)
+	}
+	if err != nil {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to commit %s, rolling back - %s", d.name, commitName, err)
+		d.resetWrite(h)
+	}
+
+	d.fs.Remove(commitName)
+	return err
+}
+
+// applyTx appends the messages staged in f, room was made for them
+// beforehand
+func (d *diskQueue) applyTx(f File) error {
+	d.applyingTx = true
+	defer func() { d.applyingTx = false }()
+
+	reader := bufio.NewReader(io.NewSectionReader(f, txHeaderSize, 1<<62))
+	var size [4]byte
+	for {
+		_, err := io.ReadFull(reader, size[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		data := make([]byte, int32(binary.BigEndian.Uint32(size[:])))
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return err
+		}
+
+		err = d.writeOne(frame{data: data})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resetWrite moves the write position back to h, dropping whatever was
+// written after it
+func (d *diskQueue) resetWrite(h txHeader) {
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+
+	for i := d.writeFileNum; i > h.writeFileNum; i-- {
+		err := d.fs.Remove(d.fileName(i))
+		if err != nil && !os.IsNotExist(err) {
+			d.logf(ERROR, "DISKQUEUE(%s) failed to remove data file - %s", d.name, err)
+		} else {
+			d.replicateRemove(d.fileName(i))
+		}
+	}
+
+	fileName := d.fileName(h.writeFileNum)
+	err := d.fs.Truncate(fileName, h.writePos)
+	if err != nil && !os.IsNotExist(err) {
+		d.logf(ERROR, "DISKQUEUE(%s) failed to truncate %s - %s", d.name, fileName, err)
+	} else if err == nil && len(d.replication.replicas) > 0 {
+		data, err := readFile(d.fs, fileName)
+		if err == nil {
+			d.replicateFile(fileName, data)
+		}
+	}
+
+	d.writeFileNum = h.writeFileNum
+	d.writePos = h.writePos
+	d.writeFileReserved = 0
+	d.writeMessages = h.writeMessages
+	d.depth = h.depth
+
+	if d.enableDiskLimitation {
+		d.updateTotalDiskSpaceUsed()
+	}
+	d.needSync = true
+}
+
+// recoverTxs removes the transactions that were not committed, and applies
+// again the ones a crash interrupted while they were committed
+//
+// a transaction that cannot be applied again is dropped, as retrying it on
+// the next start would drop whatever was written after this one
+func (d *diskQueue) recoverTxs() error {
+	fileInfos, err := d.fs.ReadDir(d.dataPath)
+	if err != nil {
+		return err
+	}
+
+	prefix := d.name + ".diskqueue.tx."
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fileName := path.Join(d.dataPath, name)
+
+		if strings.HasSuffix(name, ".commit") {
+			err = d.recoverTx(fileName)
+			if err != nil {
+				d.logf(ERROR, "DISKQUEUE(%s) dropping interrupted commit %s - %s", d.name, fileName, err)
+			}
+		}
+		d.fs.Remove(fileName)
+	}
+
+	return nil
+}
+
+func (d *diskQueue) recoverTx(fileName string) error {
+	f, err := d.fs.OpenFile(fileName, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h, err := readTxHeader(f)
+	if err != nil {
+		return err
+	}
+	if h.applied == 1 {
+		return nil
+	}
+
+	d.logf(INFO, "DISKQUEUE(%s) applying interrupted commit %s", d.name, fileName)
+	d.resetWrite(h)
+
+	if d.enableDiskLimitation {
+		count, size, err := stagedSize(f)
+		if err == nil {
+			err = d.checkDiskSpace(d.txDiskSpace(count, size))
+		}
+		if err != nil {
+			return err
+		}
+		// whatever was evicted to make room is not restored on failure
+		h = txHeader{
+			writeFileNum:  d.writeFileNum,
+			writePos:      d.writePos,
+			writeMessages: d.writeMessages,
+			depth:         d.depth,
+		}
+	}
+
+	err = d.applyTx(f)
+	if err == nil {
+		err = d.sync()
+	}
+	if err != nil {
+		d.resetWrite(h)
+		return err
+	}
+	return nil
+}
+
+// stagedSize returns the number of messages staged in f and the bytes they
+// are staged in
+func stagedSize(f File) (int64, int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(f, txHeaderSize, 1<<62))
+	var count, size int64
+	var prefix [4]byte
+	for {
+		_, err := io.ReadFull(reader, prefix[:])
+		if err == io.EOF {
+			return count, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		dataLen := int(binary.BigEndian.Uint32(prefix[:]))
+		_, err = reader.Discard(dataLen)
+		if err != nil {
+			return 0, 0, err
+		}
+		count++
+		size += int64(4 + dataLen)
+	}
+}
+
+func writeTxHeader(f File, h txHeader) error {
+	var buf [txHeaderSize]byte
+	for i, v := range []int64{h.writeFileNum, h.writePos, h.writeMessages, h.depth, h.applied} {
+		binary.BigEndian.PutUint64(buf[i*8:], uint64(v))
+	}
+	_, err := f.WriteAt(buf[:], 0)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func readTxHeader(f File) (txHeader, error) {
+	var buf [txHeaderSize]byte
+	_, err := f.ReadAt(buf[:], 0)
+	if err != nil {
+		return txHeader{}, err
+	}
+	var fields [5]int64
+	for i := range fields {
+		fields[i] = int64(binary.BigEndian.Uint64(buf[i*8:]))
+	}
+	return txHeader{
+		writeFileNum:  fields[0],
+		writePos:      fields[1],
+		writeMessages: fields[2],
+		depth:         fields[3],
+		applied:       fields[4],
+	}, nil
+}
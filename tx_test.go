@@ -0,0 +1,207 @@
+package diskqueue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueTx(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_tx" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 100, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+
+	tx, err := dq.(Transactor).Begin()
+	Nil(t, err)
+	for i := 0; i < 20; i++ {
+		Nil(t, tx.Put([]byte(strconv.Itoa(i))))
+	}
+	NotNil(t, tx.Put(make([]byte, 2<<10)))
+	Nil(t, dq.Put([]byte("before")))
+	// nothing is visible before the commit
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("before"), <-dq.ReadChan())
+	select {
+	case <-dq.ReadChan():
+		t.Fatal("read a message that was not committed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// spans several files
+	Nil(t, tx.Commit())
+	NotNil(t, tx.Commit())
+	NotNil(t, tx.Put([]byte("after")))
+	Equal(t, int64(20), dq.Depth())
+	for i := 0; i < 20; i++ {
+		Equal(t, []byte(strconv.Itoa(i)), <-dq.ReadChan())
+	}
+
+	tx, err = dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Put([]byte("dropped")))
+	Nil(t, tx.Rollback())
+	NotNil(t, tx.Rollback())
+	Equal(t, int64(0), dq.Depth())
+
+	tx, err = dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Commit())
+	Equal(t, int64(0), dq.Depth())
+
+	// staging files are removed once the transactions are done
+	matches, err := filepath.Glob(filepath.Join(tmpDir, "*.tx.*"))
+	Nil(t, err)
+	Equal(t, 0, len(matches))
+
+	// a commit fails once the queue is closed
+	tx, err = dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Put([]byte("closed")))
+	dq.Close()
+	NotNil(t, tx.Commit())
+	_, err = dq.(Transactor).Begin()
+	NotNil(t, err)
+}
+
+func TestDiskQueueTxRecovery(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_tx_recovery" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dq := New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	NotNil(t, dq)
+	d := dq.(*diskQueue)
+
+	Nil(t, dq.Put([]byte("a")))
+	Nil(t, dq.Put([]byte("b")))
+	// staged by a transaction that was never committed
+	tx, err := dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Put([]byte("uncommitted")))
+	Nil(t, tx.writer.Flush())
+	dq.Close()
+
+	// a crash while committing "x", "y", "z": "x" was appended to file 0,
+	// then the metadata was persisted after rolling to file 1 which holds
+	// part of "y"
+	var staged bytes.Buffer
+	for _, v := range []int64{0, 10, 0, 2, 0} {
+		writeInt64(&staged, v)
+	}
+	for _, msg := range []string{"x", "y", "z"} {
+		writeInt32(&staged, int32(len(msg)))
+		staged.WriteString(msg)
+	}
+	commitName := filepath.Join(tmpDir, dqName+".diskqueue.tx.1.commit")
+	Nil(t, ioutil.WriteFile(commitName, staged.Bytes(), 0600))
+	f, err := os.OpenFile(d.fileName(0), os.O_WRONLY|os.O_APPEND, 0600)
+	Nil(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 1, 'x'})
+	Nil(t, err)
+	f.Close()
+	Nil(t, ioutil.WriteFile(d.fileName(1), []byte{0, 0, 0, 1}, 0600))
+	Nil(t, ioutil.WriteFile(d.metaDataFileName(), []byte("3\n0,0\n1,0\n"), 0600))
+
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, int64(5), dq.Depth())
+	for _, expected := range []string{"a", "b", "x", "y", "z"} {
+		Equal(t, []byte(expected), <-dq.ReadChan())
+	}
+	assertFileNotExist(t, commitName)
+	assertFileNotExist(t, tx.fileName)
+	assertFileNotExist(t, d.fileName(1))
+
+	// a commit that was applied is not applied again
+	Nil(t, dq.Put([]byte("c")))
+	dq.Close()
+	staged.Truncate(0)
+	for _, v := range []int64{0, 10, 0, 2, 1} {
+		writeInt64(&staged, v)
+	}
+	Nil(t, ioutil.WriteFile(commitName, staged.Bytes(), 0600))
+
+	dq = New(dqName, tmpDir, 1024, 0, 1<<10, 2500, 2*time.Second, l)
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, []byte("c"), <-dq.ReadChan())
+	assertFileNotExist(t, commitName)
+	dq.Close()
+}
+
+func TestDiskQueueTxDiskSpace(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_tx_disk_space" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ffs := NewFaultFS(OSFS{})
+	opts := Options{
+		MaxBytesDiskSpace: 300,
+		MaxBytesPerFile:   100,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		FullPolicy:        FullReject,
+		FS:                ffs,
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+	d := dq.(*diskQueue)
+
+	// staging files count against the limit until the transaction is done
+	tx, err := dq.(Transactor).Begin()
+	Nil(t, err)
+	Equal(t, int64(maxMetaDataFileSize+txHeaderSize), <-d.usageChan)
+	for i := 0; i < 4; i++ {
+		Nil(t, tx.Put(make([]byte, 46)))
+	}
+	err = tx.Put(make([]byte, 46))
+	Equal(t, true, errors.Is(err, ErrDiskFull))
+	Nil(t, tx.Rollback())
+	Equal(t, int64(maxMetaDataFileSize), <-d.usageChan)
+	dq.Close()
+
+	// room is made for the whole transaction before it is applied, so that
+	// a rollback restores the queue as it was after evicting
+	opts.FullPolicy = FullEvictOldest
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+	d = dq.(*diskQueue)
+	for i := 0; i < 3; i++ {
+		Nil(t, dq.Put([]byte(fmt.Sprintf("%046d", i))))
+	}
+	tx, err = dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Put(make([]byte, 16)))
+	ffs.Inject(Fault{Op: OpWrite, Path: ".diskqueue.000001.dat", Times: 1, Err: syscall.ENOSPC})
+	err = tx.Commit()
+	Equal(t, true, errors.Is(err, syscall.ENOSPC))
+	Equal(t, int64(1), dq.Depth())
+	Equal(t, int64(maxMetaDataFileSize+50), <-d.usageChan)
+	Equal(t, []byte(fmt.Sprintf("%046d", 2)), <-dq.ReadChan())
+
+	tx, err = dq.(Transactor).Begin()
+	Nil(t, err)
+	Nil(t, tx.Put([]byte("committed")))
+	Nil(t, tx.Commit())
+	Equal(t, []byte("committed"), <-dq.ReadChan())
+	dq.Close()
+}
@@ -0,0 +1,92 @@
+package diskqueue
+
+import (
+	"fmt"
+)
+
+// WatermarkMetric is what a Watermark is set on
+type WatermarkMetric int
+
+const (
+	// WatermarkDepth is the number of pending messages, as reported by
+	// Depth()
+	WatermarkDepth WatermarkMetric = iota
+	// WatermarkDiskSpace is the disk space used by the queue, which is
+	// only tracked when MaxBytesDiskSpace is set
+	WatermarkDiskSpace
+)
+
+func (m WatermarkMetric) String() string {
+	switch m {
+	case WatermarkDepth:
+		return "depth"
+	case WatermarkDiskSpace:
+		return "disk space"
+	}
+	return fmt.Sprintf("WatermarkMetric(%d)", int(m))
+}
+
+// Watermark is crossed upward once Metric reaches High, and downward once
+// it is back to Low or below. Low is lower than High, so that a value moving
+// around either does not emit events over and over
+type Watermark struct {
+	Metric WatermarkMetric
+	High   int64
+	Low    int64
+}
+
+// WatermarkEvent tells that Watermark was crossed, upward if Above is set
+type WatermarkEvent struct {
+	Watermark Watermark
+	Value     int64
+	Above     bool
+}
+
+// watermarkState is a Watermark along with which side of it the queue is on
+type watermarkState struct {
+	Watermark
+	above bool
+}
+
+// checkWatermarks validates the watermarks given to NewWithOptions
+func (d *diskQueue) checkWatermarks() error {
+	for _, w := range d.watermarks {
+		if w.Low >= w.High {
+			return fmt.Errorf("invalid %s watermark: low(%d) is not below high(%d)", w.Metric, w.Low, w.High)
+		}
+		if w.Metric == WatermarkDiskSpace && !d.enableDiskLimitation {
+			return fmt.Errorf("invalid %s watermark: MaxBytesDiskSpace is not set", w.Metric)
+		}
+	}
+	return nil
+}
+
+// updateWatermarks calls onWatermark for every watermark crossed since it
+// was last called, called by ioLoop
+func (d *diskQueue) updateWatermarks() {
+	for i := range d.watermarks {
+		w := &d.watermarks[i]
+
+		var value int64
+		switch w.Metric {
+		case WatermarkDepth:
+			value = d.pending()
+		case WatermarkDiskSpace:
+			value = d.totalDiskSpaceUsed
+		}
+
+		if !w.above && value >= w.High {
+			w.above = true
+		} else if w.above && value <= w.Low {
+			w.above = false
+		} else {
+			continue
+		}
+
+		d.logf(INFO, "DISKQUEUE(%s) %s is %d, crossed watermark (high=%d, low=%d)",
+			d.name, w.Metric, value, w.High, w.Low)
+		if d.onWatermark != nil {
+			d.onWatermark(WatermarkEvent{Watermark: w.Watermark, Value: value, Above: w.above})
+		}
+	}
+}
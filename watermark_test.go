@@ -0,0 +1,78 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDiskQueueWatermarks(t *testing.T) {
+	l := NewTestLogger(t)
+	dqName := "test_disk_queue_watermarks" + strconv.Itoa(int(time.Now().Unix()))
+	tmpDir, err := ioutil.TempDir("", fmt.Sprintf("nsq-test-%d", time.Now().UnixNano()))
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	depthMark := Watermark{Metric: WatermarkDepth, High: 3, Low: 1}
+	diskMark := Watermark{Metric: WatermarkDiskSpace, High: 3000, Low: 2000}
+	events := make(chan WatermarkEvent, 10)
+	opts := Options{
+		MaxBytesDiskSpace: 6040,
+		MaxBytesPerFile:   1 << 11,
+		MinMsgSize:        0,
+		MaxMsgSize:        1 << 10,
+		SyncEvery:         2500,
+		SyncTimeout:       2 * time.Second,
+		Watermarks:        []Watermark{depthMark, diskMark},
+		OnWatermark: func(e WatermarkEvent) {
+			events <- e
+		},
+	}
+	dq := NewWithOptions(dqName, tmpDir, opts, l)
+	NotNil(t, dq)
+
+	msg := make([]byte, 1000)
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Put(msg))
+	Equal(t, WatermarkEvent{Watermark: depthMark, Value: 3, Above: true}, <-events)
+	// 3 messages, the number of messages at the end of the file and the metadata
+	Equal(t, WatermarkEvent{Watermark: diskMark, Value: 3*1004 + 8 + maxMetaDataFileSize, Above: true}, <-events)
+
+	// nothing is emitted between the low and high watermarks
+	Nil(t, dq.Put(msg))
+	<-dq.ReadChan()
+	<-dq.ReadChan()
+	Equal(t, int64(2), dq.Depth())
+	Equal(t, 0, len(events))
+
+	<-dq.ReadChan()
+	Equal(t, WatermarkEvent{Watermark: depthMark, Value: 1, Above: false}, <-events)
+	// the first file was removed once read
+	Equal(t, WatermarkEvent{Watermark: diskMark, Value: 1004 + maxMetaDataFileSize, Above: false}, <-events)
+	<-dq.ReadChan()
+	Equal(t, 0, len(events))
+
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Put(msg))
+	Nil(t, dq.Put(msg))
+	Equal(t, true, (<-events).Above)
+	Equal(t, true, (<-events).Above)
+	dq.Close()
+
+	// the watermarks are checked against the state found on start
+	dq = NewWithOptions(dqName, tmpDir, opts, l)
+	Equal(t, WatermarkEvent{Watermark: depthMark, Value: 3, Above: true}, <-events)
+	Equal(t, diskMark, (<-events).Watermark)
+	dq.Close()
+
+	opts.Watermarks = []Watermark{{Metric: WatermarkDepth, High: 1, Low: 1}}
+	Equal(t, nil, NewWithOptions(dqName, tmpDir, opts, l))
+	opts.Watermarks = []Watermark{diskMark}
+	opts.MaxBytesDiskSpace = 0
+	Equal(t, nil, NewWithOptions(dqName, tmpDir, opts, l))
+}